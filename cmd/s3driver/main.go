@@ -18,28 +18,95 @@ package main
 
 import (
 	"flag"
+	"fmt"
 	"log"
 	"os"
+	"strings"
+	"time"
 
+	"github.com/ctrox/csi-s3/pkg/config"
 	"github.com/ctrox/csi-s3/pkg/driver"
+	"github.com/ctrox/csi-s3/pkg/logging"
+	"github.com/ctrox/csi-s3/pkg/metrics"
+	"github.com/ctrox/csi-s3/pkg/mounter"
 )
 
 func init() {
 	flag.Set("logtostderr", "true")
 }
 
+const configReloadInterval = 10 * time.Second
+
 var (
-	endpoint = flag.String("endpoint", "unix://tmp/csi.sock", "CSI endpoint")
-	nodeID   = flag.String("nodeid", "", "node id")
+	endpoint       = flag.String("endpoint", "unix://tmp/csi.sock", "CSI endpoint")
+	nodeID         = flag.String("nodeid", "", "node id")
+	mode           = flag.String("mode", driver.ModeAll, "services to run: controller, node, all or mounter to run the mounter daemon on the endpoint")
+	driverName     = flag.String("drivername", "", "override the name of the driver")
+	defaultMounter = flag.String("defaultmounter", "", "mounter to use for volumes which do not specify one")
+	mounterSocket  = flag.String("mountersocket", "", "socket of the mounter daemon which runs the FUSE processes of staged volumes")
+	mountRoot      = flag.String("mountroot", "/var/lib/kubelet", "directory the mounter daemon mounts volumes below")
+	version        = flag.Bool("version", false, "print the version and exit")
+	stateDir       = flag.String("statedir", "/csi/state", "directory to persist the state of staged volumes")
+	metricsAddress = flag.String("metricsaddress", "", "address to serve prometheus metrics on, e.g. :9090")
+	probeMounters  = flag.String("probemounters", "", "comma separated list of mounters the probe checks to be usable on this node")
+	probeEndpoint  = flag.String("probeendpoint", "", "S3 endpoint the probe checks connectivity to")
+	configFile     = flag.String("config", "", "path to a yaml or json file with driver wide defaults, reloaded on change")
+	logFormat      = flag.String("logformat", logging.FormatText, "format of structured logs, text or json")
 )
 
 func main() {
 	flag.Parse()
 
-	driver, err := driver.New(*nodeID, *endpoint)
-	if err != nil {
+	if *version {
+		fmt.Println(driver.Version())
+		os.Exit(0)
+	}
+
+	if err := logging.SetFormat(*logFormat); err != nil {
 		log.Fatal(err)
 	}
+
+	if *configFile != "" {
+		cfg, err := config.Load(*configFile, driver.ValidateConfig)
+		if err != nil {
+			logging.FatalS(err, "failed to load config", "path", *configFile)
+		}
+		config.Set(cfg)
+		go config.Watch(*configFile, configReloadInterval, driver.ValidateConfig, make(chan struct{}))
+	}
+
+	if *metricsAddress != "" {
+		go metrics.Serve(*metricsAddress)
+	}
+
+	if *mode == driver.ModeMounter {
+		logging.FatalS(mounter.ServeDaemon(*endpoint, *mountRoot), "mounter daemon stopped")
+	}
+
+	driver, err := driver.New(&driver.Config{
+		NodeID:         *nodeID,
+		Endpoint:       *endpoint,
+		Mode:           *mode,
+		DriverName:     *driverName,
+		DefaultMounter: *defaultMounter,
+		MounterSocket:  *mounterSocket,
+		StateDir:       *stateDir,
+		ProbeMounters:  splitList(*probeMounters),
+		ProbeEndpoint:  *probeEndpoint,
+	})
+	if err != nil {
+		logging.FatalS(err, "failed to create driver")
+	}
 	driver.Run()
 	os.Exit(0)
 }
+
+func splitList(list string) []string {
+	items := []string{}
+	for _, item := range strings.Split(list, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
@@ -0,0 +1,267 @@
+package config
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"regexp"
+	"sync/atomic"
+	"time"
+
+	"github.com/ctrox/csi-s3/pkg/logging"
+	"sigs.k8s.io/yaml"
+)
+
+// Config holds the driver wide defaults. It is loaded from a yaml or json
+// file and can change at runtime, so it should always be accessed with Get
+// instead of keeping a reference to it.
+type Config struct {
+	// DefaultMounter is used for volumes which do not specify a mounter
+	DefaultMounter string `json:"defaultMounter,omitempty"`
+	// AllowedMounters restricts the mounters volumes can use, empty allows all
+	AllowedMounters []string `json:"allowedMounters,omitempty"`
+	// DefaultEndpoint and DefaultRegion are used if the secret does not set them
+	DefaultEndpoint string `json:"defaultEndpoint,omitempty"`
+	DefaultRegion   string `json:"defaultRegion,omitempty"`
+	// FSPath is the path within the bucket or prefix new volumes are stored in
+	FSPath string `json:"fsPath,omitempty"`
+	// S3backerDefaultSize is the size of s3backer volumes which do not request a capacity
+	S3backerDefaultSize int64 `json:"s3backerDefaultSize,omitempty"`
+	// CacheDir is the directory mounters keep their local cache in, empty disables caching
+	CacheDir string `json:"cacheDir,omitempty"`
+	// MountTimeout is how long to wait for a FUSE mount to appear
+	MountTimeout Duration `json:"mountTimeout,omitempty"`
+	// UnmountTimeout is how long to wait for a FUSE process to exit after unmounting
+	UnmountTimeout Duration `json:"unmountTimeout,omitempty"`
+	// ShutdownTimeout is how long in-flight calls may take to finish on shutdown
+	ShutdownTimeout Duration `json:"shutdownTimeout,omitempty"`
+	// StateGCInterval is how often the state of volumes which are no
+	// longer staged is cleaned up on the node, zero disables it
+	StateGCInterval Duration `json:"stateGCInterval,omitempty"`
+	// UsageInterval is how often the controller measures the usage
+	// of volumes, zero disables it
+	UsageInterval Duration `json:"usageInterval,omitempty"`
+	// Profiles are named S3 endpoints volumes select with the profile parameter
+	Profiles map[string]Profile `json:"profiles,omitempty"`
+}
+
+const (
+	// AddressingPath addresses buckets in the path of requests
+	AddressingPath = "path"
+	// AddressingVirtual addresses buckets as subdomains of the endpoint
+	AddressingVirtual = "virtual"
+)
+
+// profileNameRegexp matches valid profile names, they become part of volume IDs
+// and must not contain the / or : separators of their segments
+var profileNameRegexp = regexp.MustCompile(`^[a-z0-9]([-a-z0-9]*[a-z0-9])?$`)
+
+// ValidateProfileName returns an error unless name is a DNS label,
+// which is all a profile name in a volume ID may consist of
+func ValidateProfileName(name string) error {
+	if len(name) > 63 || !profileNameRegexp.MatchString(name) {
+		return fmt.Errorf("profile name %q must be a DNS label of lower case alphanumeric characters or '-'", name)
+	}
+	return nil
+}
+
+// Profile describes an S3 endpoint. The credentials
+// are still taken from the secrets of a volume.
+type Profile struct {
+	Endpoint string `json:"endpoint"`
+	Region   string `json:"region,omitempty"`
+	// InsecureSkipVerify disables verification of the TLS certificate of the endpoint
+	InsecureSkipVerify bool `json:"insecureSkipVerify,omitempty"`
+	// AddressingStyle is AddressingPath or AddressingVirtual, empty keeps
+	// the default of the client or mounter
+	AddressingStyle string `json:"addressingStyle,omitempty"`
+	// DefaultMounter is used for volumes of the profile which do not specify
+	// a mounter, it takes precedence over the DefaultMounter of the driver
+	DefaultMounter string `json:"defaultMounter,omitempty"`
+}
+
+// Validate returns an error if the profile is invalid
+func (p *Profile) Validate() error {
+	if p.Endpoint == "" {
+		return fmt.Errorf("endpoint is required")
+	}
+	u, err := url.Parse(p.Endpoint)
+	if err != nil {
+		return fmt.Errorf("invalid endpoint: %s", err)
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return fmt.Errorf("endpoint %s must be an http or https URL", p.Endpoint)
+	}
+	switch p.AddressingStyle {
+	case "", AddressingPath, AddressingVirtual:
+	default:
+		return fmt.Errorf("addressingStyle must be %s or %s", AddressingPath, AddressingVirtual)
+	}
+	return nil
+}
+
+// Duration is a time.Duration which is written as a string like "10s"
+type Duration struct {
+	time.Duration
+}
+
+// UnmarshalJSON parses durations like "10s" or "1m30s"
+func (d *Duration) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return fmt.Errorf("duration must be a string like \"10s\": %s", err)
+	}
+	duration, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	d.Duration = duration
+	return nil
+}
+
+// MarshalJSON writes the duration as a string
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(d.String())
+}
+
+// Default returns the defaults which are used for unset values
+func Default() *Config {
+	return &Config{
+		FSPath:              "csi-fs",
+		DefaultRegion:       "us-east-1",
+		S3backerDefaultSize: 1024 * 1024 * 1024, // 1GiB
+		MountTimeout:        Duration{10 * time.Second},
+		UnmountTimeout:      Duration{20 * time.Second},
+		ShutdownTimeout:     Duration{30 * time.Second},
+	}
+}
+
+var current atomic.Value
+
+func init() {
+	current.Store(Default())
+}
+
+// Get returns the current configuration
+func Get() *Config {
+	return current.Load().(*Config)
+}
+
+// Set replaces the current configuration
+func Set(cfg *Config) {
+	current.Store(cfg)
+}
+
+// Validate returns an error if the configuration is invalid
+func (c *Config) Validate() error {
+	if c.S3backerDefaultSize <= 0 {
+		return fmt.Errorf("s3backerDefaultSize must be greater than 0")
+	}
+	if c.MountTimeout.Duration <= 0 {
+		return fmt.Errorf("mountTimeout must be greater than 0")
+	}
+	if c.UnmountTimeout.Duration <= 0 {
+		return fmt.Errorf("unmountTimeout must be greater than 0")
+	}
+	if c.ShutdownTimeout.Duration <= 0 {
+		return fmt.Errorf("shutdownTimeout must be greater than 0")
+	}
+	if c.StateGCInterval.Duration < 0 {
+		return fmt.Errorf("stateGCInterval must not be negative")
+	}
+	if c.UsageInterval.Duration < 0 {
+		return fmt.Errorf("usageInterval must not be negative")
+	}
+	for name, p := range c.Profiles {
+		if err := ValidateProfileName(name); err != nil {
+			return err
+		}
+		if err := p.Validate(); err != nil {
+			return fmt.Errorf("profile %s: %s", name, err)
+		}
+	}
+	return nil
+}
+
+// Profile returns the endpoint profile called name
+func (c *Config) Profile(name string) (Profile, bool) {
+	p, ok := c.Profiles[name]
+	return p, ok
+}
+
+// IsMounterAllowed returns true if volumes may use mounterType
+func (c *Config) IsMounterAllowed(mounterType string) bool {
+	if len(c.AllowedMounters) == 0 {
+		return true
+	}
+	for _, m := range c.AllowedMounters {
+		if m == mounterType {
+			return true
+		}
+	}
+	return false
+}
+
+// Load reads the configuration file at path, unset values are defaulted.
+// validate is called in addition to Validate if it is not nil.
+func Load(path string, validate func(*Config) error) (*Config, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return parse(b, validate)
+}
+
+func parse(b []byte, validate func(*Config) error) (*Config, error) {
+	cfg := Default()
+	if err := yaml.UnmarshalStrict(b, cfg); err != nil {
+		return nil, fmt.Errorf("invalid config: %s", err)
+	}
+	if err := cfg.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid config: %s", err)
+	}
+	if validate != nil {
+		if err := validate(cfg); err != nil {
+			return nil, fmt.Errorf("invalid config: %s", err)
+		}
+	}
+	return cfg, nil
+}
+
+// Watch checks the file at path for changes every interval until stop is
+// closed and replaces the current configuration if it changed. Invalid
+// changes are logged and ignored, so the last valid configuration stays
+// active. Mounts which already exist are not affected by a reload.
+func Watch(path string, interval time.Duration, validate func(*Config) error, stop <-chan struct{}) {
+	last, err := ioutil.ReadFile(path)
+	if err != nil {
+		logging.ErrorS(err, "failed to read config", "path", path)
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+		b, err := ioutil.ReadFile(path)
+		if err != nil {
+			logging.ErrorS(err, "failed to read config", "path", path)
+			continue
+		}
+		if bytes.Equal(b, last) {
+			continue
+		}
+		last = b
+		cfg, err := parse(b, validate)
+		if err != nil {
+			logging.ErrorS(err, "ignoring changed config", "path", path)
+			continue
+		}
+		Set(cfg)
+		logging.InfoS("reloaded config", "path", path)
+	}
+}
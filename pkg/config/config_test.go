@@ -0,0 +1,95 @@
+package config
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParse(t *testing.T) {
+	cfg, err := parse([]byte("defaultMounter: rclone\nmountTimeout: 30s\n"), nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if cfg.DefaultMounter != "rclone" {
+		t.Errorf("DefaultMounter = %s, want rclone", cfg.DefaultMounter)
+	}
+	if cfg.MountTimeout.Duration != 30*time.Second {
+		t.Errorf("MountTimeout = %s, want 30s", cfg.MountTimeout)
+	}
+	// unset values keep their defaults
+	if cfg.FSPath != Default().FSPath {
+		t.Errorf("FSPath = %s, want %s", cfg.FSPath, Default().FSPath)
+	}
+}
+
+func TestParseJSON(t *testing.T) {
+	cfg, err := parse([]byte(`{"allowedMounters": ["rclone", "s3fs"], "stateGCInterval": "5m", "usageInterval": "1h"}`), nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if !cfg.IsMounterAllowed("s3fs") || cfg.IsMounterAllowed("goofys") {
+		t.Errorf("unexpected allowed mounters %v", cfg.AllowedMounters)
+	}
+	if cfg.StateGCInterval.Duration != 5*time.Minute {
+		t.Errorf("StateGCInterval = %s, want 5m", cfg.StateGCInterval)
+	}
+	if cfg.UsageInterval.Duration != time.Hour {
+		t.Errorf("UsageInterval = %s, want 1h", cfg.UsageInterval)
+	}
+}
+
+func TestParseProfiles(t *testing.T) {
+	cfg, err := parse([]byte(`
+profiles:
+  aws:
+    endpoint: https://s3.eu-west-1.amazonaws.com
+    region: eu-west-1
+    addressingStyle: virtual
+  minio:
+    endpoint: https://minio.storage.svc:9000
+    insecureSkipVerify: true
+    defaultMounter: rclone
+`), nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	aws, ok := cfg.Profile("aws")
+	if !ok || aws.Region != "eu-west-1" || aws.AddressingStyle != AddressingVirtual {
+		t.Errorf("unexpected profile aws %+v", aws)
+	}
+	minio, ok := cfg.Profile("minio")
+	if !ok || !minio.InsecureSkipVerify || minio.DefaultMounter != "rclone" {
+		t.Errorf("unexpected profile minio %+v", minio)
+	}
+	if _, ok := cfg.Profile("gcs"); ok {
+		t.Error("expected unknown profile gcs")
+	}
+}
+
+func TestParseInvalid(t *testing.T) {
+	for _, in := range []string{
+		"unknownField: true",
+		"mountTimeout: 10",
+		"mountTimeout: -1s",
+		"s3backerDefaultSize: 0",
+		"usageInterval: -1m",
+		"profiles: {minio: {region: eu}}",
+		"profiles: {minio: {endpoint: minio:9000}}",
+		"profiles: {minio: {endpoint: 'http://minio:9000', addressingStyle: dns}}",
+		"profiles: {Min:IO: {endpoint: 'http://minio:9000'}}",
+		"profiles: {'a/b': {endpoint: 'http://minio:9000'}}",
+		"profiles: {'x:y': {endpoint: 'http://minio:9000'}}",
+		"profiles: {'': {endpoint: 'http://minio:9000'}}",
+		"profiles: {" + strings.Repeat("a", 64) + ": {endpoint: 'http://minio:9000'}}",
+	} {
+		if _, err := parse([]byte(in), nil); err == nil {
+			t.Errorf("expected error for %q", in)
+		}
+	}
+	validate := func(*Config) error { return errors.New("rejected") }
+	if _, err := parse([]byte("defaultMounter: rclone"), validate); err == nil {
+		t.Error("expected error of validate func")
+	}
+}
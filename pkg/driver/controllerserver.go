@@ -19,86 +19,224 @@ package driver
 import (
 	"crypto/sha1"
 	"encoding/hex"
+	"errors"
 	"fmt"
 	"io"
 	"path"
 	"strconv"
 	"strings"
 
+	"github.com/ctrox/csi-s3/pkg/config"
+	"github.com/ctrox/csi-s3/pkg/logging"
 	"github.com/ctrox/csi-s3/pkg/mounter"
 	"github.com/ctrox/csi-s3/pkg/s3"
-	"github.com/golang/glog"
 	"golang.org/x/net/context"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
 
 	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/kubernetes-csi/csi-lib-utils/protosanitizer"
 	csicommon "github.com/kubernetes-csi/drivers/pkg/csi-common"
 )
 
+// maxForeignObjects is the number of objects outside of a volume
+// listed in the error of DeleteVolume
+const maxForeignObjects = 10
+
 type controllerServer struct {
 	*csicommon.DefaultControllerServer
+	driverName     string
+	defaultMounter string
+	locks          *operationLocks
+	// newClient returns the object store of the S3 endpoint of a request
+	newClient func(cfg *s3.Config) (s3.ObjectStore, error)
+	// kube lists the volumes whose usage is measured, nil outside of a cluster
+	kube kubeClient
+	// exceeded records which volumes exceeded their capacity when their
+	// usage has last been measured, it is only accessed by runUsage
+	exceeded map[string]bool
+	// quotas records the bucket quotas set on volumes, which are only
+	// set again if their capacity changes, it is only accessed by runUsage
+	quotas map[string]int64
 }
 
-const (
-	defaultFsPath = "csi-fs"
-)
+// newObjectStore returns a client of the S3 endpoint of cfg
+func newObjectStore(cfg *s3.Config) (s3.ObjectStore, error) {
+	client, err := s3.NewClient(cfg)
+	if err != nil {
+		return nil, err
+	}
+	return client, nil
+}
 
 func (cs *controllerServer) CreateVolume(ctx context.Context, req *csi.CreateVolumeRequest) (*csi.CreateVolumeResponse, error) {
 	params := req.GetParameters()
 	capacityBytes := int64(req.GetCapacityRange().GetRequiredBytes())
+	profile := params[s3.ProfileKey]
+	// the profile is part of the volume ID, DeleteVolume must find it again
+	if profile != "" {
+		if err := config.ValidateProfileName(profile); err != nil {
+			return nil, status.Error(codes.InvalidArgument, err.Error())
+		}
+	}
+	cfg, err := s3Config(req.GetSecrets(), profile)
+	if err != nil {
+		return nil, err
+	}
+	// the mounter of the profile takes precedence over the driver default
 	mounterType := params[mounter.TypeKey]
-	volumeID := sanitizeVolumeID(req.GetName())
-	bucketName := volumeID
+	if mounterType == "" {
+		mounterType = cfg.Mounter
+	}
+	if mounterType == "" {
+		mounterType = defaultMounter(cs.defaultMounter)
+	}
+	name := sanitizeVolumeID(req.GetName())
+	bucketName := name
 	prefix := ""
 	usePrefix, usePrefixError := strconv.ParseBool(params[mounter.UsePrefix])
-	defaultFsPath := defaultFsPath
+	usePrefix = usePrefixError == nil && usePrefix
+	defaultFsPath := config.Get().FSPath
+
+	// bucket and prefix may be templates like ${pvc.namespace}
+	bucketOverride, hasBucketOverride := params[mounter.BucketKey]
+	if hasBucketOverride {
+		bucketOverride, err = renderTemplate(bucketOverride, params)
+		if err != nil {
+			return nil, status.Error(codes.InvalidArgument, fmt.Sprintf("invalid %s: %s", mounter.BucketKey, err))
+		}
+	}
+	prefixOverride, err := renderTemplate(params[mounter.VolumePrefix], params)
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, fmt.Sprintf("invalid %s: %s", mounter.VolumePrefix, err))
+	}
 
 	// check if bucket name is overridden
-	if nameOverride, ok := params[mounter.BucketKey]; ok {
-		bucketName = nameOverride
-		prefix = volumeID
-		volumeID = path.Join(bucketName, prefix)
+	if hasBucketOverride {
+		bucketName = bucketOverride
+		prefix = name
 	}
 
 	// check if volume prefix is overridden
-	if overridePrefix := usePrefix; usePrefixError == nil && overridePrefix {
-		prefix = ""
+	if usePrefix {
+		prefix = prefixOverride
 		defaultFsPath = ""
-		if prefixOverride, ok := params[mounter.VolumePrefix]; ok && prefixOverride != "" {
-			prefix = prefixOverride
-		}
-		volumeID = path.Join(bucketName, prefix)
+	} else if isTemplate(params[mounter.VolumePrefix]) {
+		// the volume still owns the prefix and it is removed with the volume.
+		// Plain prefixes are ignored without usePrefix like they always were,
+		// every volume of the storage class would map to the same prefix.
+		prefix = prefixOverride
 	}
+	volumeID := volumeHandle{profile: profile, bucket: bucketName, prefix: prefix}.String()
 
 	if err := cs.Driver.ValidateControllerServiceRequest(csi.ControllerServiceCapability_RPC_CREATE_DELETE_VOLUME); err != nil {
-		glog.V(3).Infof("invalid create volume req: %v", req)
+		logging.V(3).InfoS("invalid create volume request", "request", protosanitizer.StripSecrets(req))
 		return nil, err
 	}
 
 	// Check arguments
-	if len(volumeID) == 0 {
+	if len(req.GetName()) == 0 {
 		return nil, status.Error(codes.InvalidArgument, "Name missing in request")
 	}
 	if req.GetVolumeCapabilities() == nil {
 		return nil, status.Error(codes.InvalidArgument, "Volume Capabilities missing in request")
 	}
+	if err := validateBucketName(bucketName); err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	if err := validatePrefix(prefix); err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+
+	release, err := cs.locks.lockVolume(volumeID)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+
+	if mounterType != "" && !config.Get().IsMounterAllowed(mounterType) {
+		return nil, status.Error(codes.InvalidArgument, fmt.Sprintf("Mounter %s is not allowed", mounterType))
+	}
+
+	storeType := params[s3.MetaStoreKey]
+	if !s3.IsSupportedMetaStore(storeType) {
+		return nil, status.Error(codes.InvalidArgument, fmt.Sprintf("Unsupported metadata store %s", storeType))
+	}
+	if storeType == s3.MetaStoreMarker && prefix == "" {
+		return nil, status.Error(codes.InvalidArgument, fmt.Sprintf("Metadata store %s requires volumes with a prefix", storeType))
+	}
+
+	fsType := params[mounter.FsTypeKey]
+	if fsType == "" {
+		fsType = volumeCapabilitiesFsType(req.GetVolumeCapabilities())
+	}
+	if !mounter.IsSupportedFsType(fsType) {
+		return nil, status.Error(codes.InvalidArgument, fmt.Sprintf("Unsupported fsType %s", fsType))
+	}
 
-	glog.V(4).Infof("Got a request to create volume %s", volumeID)
+	logging.V(4).InfoS("got a request to create volume", "volumeID", volumeID)
 
 	meta := &s3.FSMeta{
-		BucketName:    bucketName,
-		UsePrefix:     usePrefix,
-		Prefix:        prefix,
-		Mounter:       mounterType,
-		CapacityBytes: capacityBytes,
-		FSPath:        defaultFsPath,
+		BucketName:       bucketName,
+		Profile:          profile,
+		VolumeName:       req.GetName(),
+		UsePrefix:        usePrefix,
+		Prefix:           prefix,
+		Mounter:          mounterType,
+		CapacityBytes:    capacityBytes,
+		FSPath:           defaultFsPath,
+		FSType:           fsType,
+		MkfsOptions:      strings.Fields(params[mounter.MkfsOptionsKey]),
+		UID:              params[mounter.UIDKey],
+		GID:              params[mounter.GIDKey],
+		Umask:            params[mounter.UmaskKey],
+		DirMode:          params[mounter.DirModeKey],
+		FileMode:         params[mounter.FileModeKey],
+		ReclaimPolicy:    params[s3.ReclaimPolicyKey],
+		QuotaEnforcement: params[s3.QuotaEnforcementKey],
+	}
+	if err := mounter.ValidateOwnership(meta); err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	if meta.ReclaimPolicy == "" {
+		meta.ReclaimPolicy = s3.DefaultReclaimPolicy(usePrefix, prefix)
+		if storeType == s3.MetaStoreContext {
+			meta.ReclaimPolicy = s3.ReclaimRetain
+		}
+	}
+	if err := s3.ValidateReclaimPolicy(meta); err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	// DeleteVolume only gets the volume ID and cannot find the metadata
+	// in the volume context, so it could never remove the volume
+	if storeType == s3.MetaStoreContext && meta.ReclaimPolicy != s3.ReclaimRetain {
+		return nil, status.Error(codes.InvalidArgument, fmt.Sprintf(
+			"Metadata store %s requires reclaim policy %s", storeType, s3.ReclaimRetain,
+		))
+	}
+	if err := s3.ValidateQuotaEnforcement(meta); err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
 	}
 
-	client, err := s3.NewClientFromSecret(req.GetSecrets())
+	client, err := cs.newClient(cfg)
 	if err != nil {
 		return nil, fmt.Errorf("failed to initialize S3 client: %s", err)
 	}
+	volumeContext := map[string]string{}
+	for k, v := range params {
+		volumeContext[k] = v
+	}
+	// the context describes the volume, not the templates it was created from
+	if hasBucketOverride {
+		volumeContext[mounter.BucketKey] = bucketName
+	}
+	if _, ok := params[mounter.VolumePrefix]; ok {
+		volumeContext[mounter.VolumePrefix] = prefix
+	}
+	store, err := client.MetaStore(storeType, volumeContext)
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
 
 	exists, err := client.BucketExists(bucketName)
 	if err != nil {
@@ -106,88 +244,161 @@ func (cs *controllerServer) CreateVolume(ctx context.Context, req *csi.CreateVol
 	}
 
 	if exists {
-		// get meta, ignore errors as it could just mean meta does not exist yet
-		m, err := client.GetFSMeta(bucketName, prefix)
+		m, err := store.GetFSMeta(bucketName, prefix)
+		if err != nil && !errors.Is(err, s3.ErrFSMetaNotFound) {
+			return nil, fmt.Errorf("failed to get metadata of volume %s: %w", volumeID, err)
+		}
 		if err == nil {
+			if err := s3.CheckSchemaVersion(m); err != nil {
+				return nil, status.Error(codes.FailedPrecondition, fmt.Sprintf("volume %s: %s", volumeID, err))
+			}
+			// volumes which share an existing prefix are identical by design,
+			// others must not take over the bucket or prefix of another volume
+			if !usePrefix && m.VolumeName != "" && !strings.EqualFold(m.VolumeName, req.GetName()) {
+				return nil, status.Error(
+					codes.AlreadyExists, fmt.Sprintf("%s is already used by volume %s", path.Join(bucketName, prefix), m.VolumeName),
+				)
+			}
 			// Check if volume capacity requested is bigger than the already existing capacity
 			if capacityBytes > m.CapacityBytes {
 				return nil, status.Error(
 					codes.AlreadyExists, fmt.Sprintf("Volume with the same name: %s but with smaller size already exist", volumeID),
 				)
 			}
+			// only replace the metadata we have just seen
+			meta.ETag = m.ETag
+			meta.BucketCreated = m.BucketCreated
 		}
 	} else {
 		if err = client.CreateBucket(bucketName); err != nil {
 			return nil, fmt.Errorf("failed to create bucket %s: %v", bucketName, err)
 		}
+		// record that the bucket belongs to the volume before anything else
+		// can fail, a retry finds the bucket and must not take it for foreign
+		meta.BucketCreated = true
+		if err := store.SetFSMeta(meta); err != nil {
+			// the retry creates the bucket again
+			if err := client.RemoveBucket(bucketName); err != nil {
+				logging.ErrorS(err, "failed to remove bucket without metadata", "bucket", bucketName)
+			}
+			return nil, setFSMetaError(volumeID, err)
+		}
 	}
 
 	if err = client.CreatePrefix(bucketName, path.Join(prefix, defaultFsPath)); err != nil && prefix != "" {
 		return nil, fmt.Errorf("failed to create prefix %s: %v", path.Join(prefix, defaultFsPath), err)
 	}
 
-	if err := client.SetFSMeta(meta); err != nil {
-		return nil, fmt.Errorf("error setting bucket metadata: %w", err)
+	if err := store.SetFSMeta(meta); err != nil {
+		return nil, setFSMetaError(volumeID, err)
 	}
 
-	glog.V(4).Infof("create volume %s", volumeID)
+	logging.V(4).InfoS("created volume", "volumeID", volumeID)
 	return &csi.CreateVolumeResponse{
 		Volume: &csi.Volume{
 			VolumeId:      volumeID,
 			CapacityBytes: capacityBytes,
-			VolumeContext: req.GetParameters(),
+			VolumeContext: volumeContext,
 		},
 	}, nil
 }
 
 func (cs *controllerServer) DeleteVolume(ctx context.Context, req *csi.DeleteVolumeRequest) (*csi.DeleteVolumeResponse, error) {
 	volumeID := req.GetVolumeId()
-	bucketName, prefix := volumeIDToBucketPrefix(volumeID)
-	var meta *s3.FSMeta
 
 	// Check arguments
 	if len(volumeID) == 0 {
 		return nil, status.Error(codes.InvalidArgument, "Volume ID missing in request")
 	}
+	handle, err := parseVolumeID(volumeID)
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	bucketName, prefix := handle.bucket, handle.prefix
 
 	if err := cs.Driver.ValidateControllerServiceRequest(csi.ControllerServiceCapability_RPC_CREATE_DELETE_VOLUME); err != nil {
-		glog.V(3).Infof("Invalid delete volume req: %v", req)
+		logging.V(3).InfoS("invalid delete volume request", "request", protosanitizer.StripSecrets(req))
+		return nil, err
+	}
+
+	// lock the versioned ID, CreateVolume locks the same for this volume
+	release, err := cs.locks.lockVolume(handle.String())
+	if err != nil {
 		return nil, err
 	}
-	glog.V(4).Infof("Deleting volume %s", volumeID)
+	defer release()
+	logging.V(4).InfoS("deleting volume", "volumeID", volumeID)
 
-	client, err := s3.NewClientFromSecret(req.GetSecrets())
+	cfg, err := s3Config(req.GetSecrets(), handle.profile)
+	if err != nil {
+		return nil, err
+	}
+	client, err := cs.newClient(cfg)
 	if err != nil {
 		return nil, fmt.Errorf("failed to initialize S3 client: %s", err)
 	}
 
-	if meta, err = client.GetFSMeta(bucketName, prefix); err != nil {
-		glog.V(5).Infof("FSMeta of volume %s does not exist, ignoring delete request", volumeID)
+	meta, store, err := findFSMeta(client, bucketName, prefix)
+	if errors.Is(err, s3.ErrFSMetaNotFound) {
+		logging.V(5).InfoS("FSMeta of volume does not exist, ignoring delete request", "volumeID", volumeID)
 		return &csi.DeleteVolumeResponse{}, nil
 	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get metadata of volume %s: %w", volumeID, err)
+	}
+	// the metadata found might belong to another volume if the ID has been
+	// truncated or altered, its data must not be removed then
+	if meta.BucketName != bucketName || meta.Prefix != prefix {
+		return nil, status.Error(codes.FailedPrecondition, fmt.Sprintf(
+			"metadata of volume %s belongs to %s, refusing to delete it", volumeID, path.Join(meta.BucketName, meta.Prefix),
+		))
+	}
+
+	if err := s3.ValidateReclaimPolicy(meta); err != nil {
+		return nil, status.Error(codes.FailedPrecondition, fmt.Sprintf("refusing to delete volume %s: %s", volumeID, err))
+	}
 
 	var deleteErr error
-	if meta.UsePrefix {
-		// UsePrefix is true, we do not delete anything
-		glog.V(4).Infof("Nothing to remove for %s", bucketName)
+	if meta.ReclaimPolicy == s3.ReclaimRetain {
+		logging.V(4).InfoS("nothing to remove", "bucket", bucketName)
 		return &csi.DeleteVolumeResponse{}, nil
-	} else if prefix == "" {
-		// prefix is empty, we delete the whole bucket
+	} else if meta.ReclaimPolicy == s3.ReclaimDeleteBucket {
+		// the bucket might be shared, only remove it if it is the volume's own
+		if !meta.BucketCreated {
+			return nil, status.Error(codes.FailedPrecondition, fmt.Sprintf(
+				"refusing to delete volume %s: bucket %s has not been created by the driver", volumeID, bucketName,
+			))
+		}
+		foreign, err := s3.ForeignObjects(client, meta)
+		if err != nil {
+			return nil, fmt.Errorf("failed to list objects of bucket %s: %w", bucketName, err)
+		}
+		if len(foreign) > maxForeignObjects {
+			foreign = append(foreign[:maxForeignObjects], "...")
+		}
+		if len(foreign) > 0 {
+			return nil, status.Error(codes.FailedPrecondition, fmt.Sprintf(
+				"refusing to delete volume %s: bucket %s contains objects outside of the volume: %s",
+				volumeID, bucketName, strings.Join(foreign, ", "),
+			))
+		}
 		if err := client.RemoveBucket(bucketName); err != nil {
 			deleteErr = err
 		}
-		glog.V(4).Infof("Bucket %s removed", bucketName)
+		logging.V(4).InfoS("bucket removed", "bucket", bucketName)
 	} else {
 		if err := client.RemovePrefix(bucketName, prefix); err != nil {
 			deleteErr = fmt.Errorf("unable to remove prefix: %w", err)
 		}
-		glog.V(4).Infof("Prefix %s removed", prefix)
+		logging.V(4).InfoS("prefix removed", "bucket", bucketName, "prefix", prefix)
 	}
 
 	if deleteErr != nil {
-		glog.Warning("remove volume failed, will ensure fsmeta exists to avoid losing control over volume")
-		if err := client.SetFSMeta(meta); err != nil {
-			glog.Error(err)
+		logging.WarningS("remove volume failed, will ensure fsmeta exists to avoid losing control over volume", "volumeID", volumeID)
+		// only create the metadata if it has been removed already
+		meta.ETag = ""
+		if err := store.SetFSMeta(meta); err != nil && !errors.Is(err, s3.ErrFSMetaConflict) {
+			logging.ErrorS(err, "failed to restore fsmeta", "volumeID", volumeID)
 		}
 		return nil, deleteErr
 	}
@@ -203,9 +414,17 @@ func (cs *controllerServer) ValidateVolumeCapabilities(ctx context.Context, req
 	if req.GetVolumeCapabilities() == nil {
 		return nil, status.Error(codes.InvalidArgument, "Volume capabilities missing in request")
 	}
-	bucketName, prefix := volumeIDToBucketPrefix(req.GetVolumeId())
+	handle, err := parseVolumeID(req.GetVolumeId())
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	bucketName, prefix := handle.bucket, handle.prefix
 
-	client, err := s3.NewClientFromSecret(req.GetSecrets())
+	cfg, err := s3Config(req.GetSecrets(), volumeProfile(req.GetVolumeId(), req.GetVolumeContext()))
+	if err != nil {
+		return nil, err
+	}
+	client, err := cs.newClient(cfg)
 	if err != nil {
 		return nil, fmt.Errorf("failed to initialize S3 client: %s", err)
 	}
@@ -219,7 +438,11 @@ func (cs *controllerServer) ValidateVolumeCapabilities(ctx context.Context, req
 		return nil, status.Error(codes.NotFound, fmt.Sprintf("bucket of volume with id %s does not exist", req.GetVolumeId()))
 	}
 
-	if _, err := client.GetFSMeta(bucketName, prefix); err != nil {
+	store, err := client.MetaStore(req.GetVolumeContext()[s3.MetaStoreKey], req.GetVolumeContext())
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	if _, err := store.GetFSMeta(bucketName, prefix); err != nil {
 		// return an error if the fsmeta of the requested volume does not exist
 		return nil, status.Error(codes.NotFound, fmt.Sprintf("fsmeta of volume with id %s does not exist", req.GetVolumeId()))
 	}
@@ -250,6 +473,10 @@ func (cs *controllerServer) ControllerExpandVolume(ctx context.Context, req *csi
 	return &csi.ControllerExpandVolumeResponse{}, status.Error(codes.Unimplemented, "ControllerExpandVolume is not implemented")
 }
 
+func (cs *controllerServer) ControllerGetVolume(ctx context.Context, req *csi.ControllerGetVolumeRequest) (*csi.ControllerGetVolumeResponse, error) {
+	return nil, status.Error(codes.Unimplemented, "ControllerGetVolume is not implemented")
+}
+
 func sanitizeVolumeID(volumeID string) string {
 	volumeID = strings.ToLower(volumeID)
 	if len(volumeID) > 63 {
@@ -260,15 +487,46 @@ func sanitizeVolumeID(volumeID string) string {
 	return volumeID
 }
 
-// volumeIDToBucketPrefix returns the bucket name and prefix based on the volumeID.
-// Prefix is empty if volumeID does not have a slash in the name.
-func volumeIDToBucketPrefix(volumeID string) (string, string) {
-	// if the volumeID has a slash in it, this volume is
-	// stored under a certain prefix within the bucket.
-	splitVolumeID := strings.Split(volumeID, "/")
-	if len(splitVolumeID) > 1 {
-		return splitVolumeID[0], splitVolumeID[1]
+// volumeCapabilitiesFsType returns the first fsType requested
+// by a mount capability or an empty string if none is set.
+func volumeCapabilitiesFsType(caps []*csi.VolumeCapability) string {
+	for _, c := range caps {
+		if fsType := c.GetMount().GetFsType(); fsType != "" {
+			return fsType
+		}
 	}
+	return ""
+}
 
-	return volumeID, ""
+// setFSMetaError returns the error of CreateVolume for a failed metadata
+// update, concurrent updates abort the call
+func setFSMetaError(volumeID string, err error) error {
+	if errors.Is(err, s3.ErrFSMetaConflict) {
+		return status.Error(codes.Aborted, fmt.Sprintf("metadata of volume %s has been modified concurrently", volumeID))
+	}
+	if errors.Is(err, s3.ErrFSMetaNewer) {
+		return status.Error(codes.FailedPrecondition, fmt.Sprintf("volume %s: %s", volumeID, err))
+	}
+	return fmt.Errorf("error setting bucket metadata: %w", err)
+}
+
+// findFSMeta returns the metadata of a volume and the store it is kept in.
+// Only stores within the bucket are checked as the volume context is unknown,
+// volumes of the context store are always retained.
+func findFSMeta(client s3.ObjectStore, bucketName, prefix string) (*s3.FSMeta, s3.MetaStore, error) {
+	var err error
+	for _, storeType := range []string{s3.MetaStoreObject, s3.MetaStoreMarker} {
+		var store s3.MetaStore
+		if store, err = client.MetaStore(storeType, nil); err != nil {
+			return nil, nil, err
+		}
+		var meta *s3.FSMeta
+		if meta, err = store.GetFSMeta(bucketName, prefix); err == nil {
+			return meta, store, nil
+		}
+		if !errors.Is(err, s3.ErrFSMetaNotFound) {
+			return nil, nil, err
+		}
+	}
+	return nil, nil, err
 }
@@ -0,0 +1,547 @@
+package driver
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"testing"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/ctrox/csi-s3/pkg/config"
+	"github.com/ctrox/csi-s3/pkg/s3"
+	csicommon "github.com/kubernetes-csi/drivers/pkg/csi-common"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func newTestControllerServer(store s3.ObjectStore) *controllerServer {
+	d := csicommon.NewCSIDriver(driverName, vendorVersion, "test-node")
+	d.AddControllerServiceCapabilities([]csi.ControllerServiceCapability_RPC_Type{csi.ControllerServiceCapability_RPC_CREATE_DELETE_VOLUME})
+	return &controllerServer{
+		DefaultControllerServer: csicommon.NewDefaultControllerServer(d),
+		driverName:              driverName,
+		locks:                   newOperationLocks(),
+		newClient: func(cfg *s3.Config) (s3.ObjectStore, error) {
+			return store, nil
+		},
+	}
+}
+
+func createVolumeRequest(name string, params map[string]string) *csi.CreateVolumeRequest {
+	return &csi.CreateVolumeRequest{
+		Name:       name,
+		Parameters: params,
+		VolumeCapabilities: []*csi.VolumeCapability{{
+			AccessType: &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{}},
+			AccessMode: &csi.VolumeCapability_AccessMode{Mode: csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER},
+		}},
+		CapacityRange: &csi.CapacityRange{RequiredBytes: 1024},
+	}
+}
+
+func TestCreateVolume(t *testing.T) {
+	store := s3.NewFakeObjectStore()
+	cs := newTestControllerServer(store)
+
+	resp, err := cs.CreateVolume(context.Background(), createVolumeRequest("PVC-1", map[string]string{"mounter": "rclone"}))
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if resp.GetVolume().GetVolumeId() != "v1//pvc-1" {
+		t.Errorf("expected volume ID v1//pvc-1, got %s", resp.GetVolume().GetVolumeId())
+	}
+	meta, err := store.GetFSMeta("pvc-1", "")
+	if err != nil {
+		t.Fatalf("expected metadata to be stored: %s", err)
+	}
+	if meta.Mounter != "rclone" || meta.FSPath != "csi-fs" || meta.CapacityBytes != 1024 {
+		t.Errorf("unexpected metadata: %+v", meta)
+	}
+
+	// creating the volume again succeeds
+	if _, err := cs.CreateVolume(context.Background(), createVolumeRequest("pvc-1", map[string]string{"mounter": "rclone"})); err != nil {
+		t.Errorf("expected CreateVolume to be idempotent, got %s", err)
+	}
+	// but not with a larger size
+	req := createVolumeRequest("pvc-1", map[string]string{"mounter": "rclone"})
+	req.CapacityRange.RequiredBytes = 2048
+	if _, err := cs.CreateVolume(context.Background(), req); status.Code(err) != codes.AlreadyExists {
+		t.Errorf("expected AlreadyExists, got %v", err)
+	}
+}
+
+func TestCreateVolumeWithBucket(t *testing.T) {
+	store := s3.NewFakeObjectStore()
+	cs := newTestControllerServer(store)
+
+	resp, err := cs.CreateVolume(context.Background(), createVolumeRequest("pvc-1", map[string]string{"bucket": "shared"}))
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if resp.GetVolume().GetVolumeId() != "v1//shared/pvc-1" {
+		t.Errorf("expected volume ID v1//shared/pvc-1, got %s", resp.GetVolume().GetVolumeId())
+	}
+	expected := []string{"pvc-1/.metadata.json", "pvc-1/csi-fs/"}
+	if objects := store.Objects("shared"); !reflect.DeepEqual(objects, expected) {
+		t.Errorf("expected objects %v, got %v", expected, objects)
+	}
+
+	// a prefix without placeholders is only used with usePrefix
+	resp, err = cs.CreateVolume(context.Background(), createVolumeRequest("pvc-2", map[string]string{"bucket": "shared", "prefix": "data"}))
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if resp.GetVolume().GetVolumeId() != "v1//shared/pvc-2" || resp.GetVolume().GetVolumeContext()["prefix"] != "pvc-2" {
+		t.Errorf("expected prefix to be ignored, got %s and %v", resp.GetVolume().GetVolumeId(), resp.GetVolume().GetVolumeContext())
+	}
+	if _, err := cs.CreateVolume(context.Background(), createVolumeRequest("pvc-3", map[string]string{"bucket": "shared", "prefix": "data"})); err != nil {
+		t.Errorf("unexpected error for another volume of the storage class: %s", err)
+	}
+}
+
+func TestCreateVolumeMetaStores(t *testing.T) {
+	store := s3.NewFakeObjectStore()
+	cs := newTestControllerServer(store)
+
+	resp, err := cs.CreateVolume(context.Background(), createVolumeRequest("pvc-1", map[string]string{
+		"bucket":        "shared",
+		"metadataStore": "marker",
+	}))
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	expected := []string{"pvc-1/", "pvc-1/csi-fs/"}
+	if objects := store.Objects("shared"); !reflect.DeepEqual(objects, expected) {
+		t.Errorf("expected objects %v, got %v", expected, objects)
+	}
+	marker, _ := store.MetaStore(s3.MetaStoreMarker, nil)
+	if _, err := marker.GetFSMeta("shared", "pvc-1"); err != nil {
+		t.Errorf("expected metadata in the prefix marker: %s", err)
+	}
+
+	resp, err = cs.CreateVolume(context.Background(), createVolumeRequest("pvc-2", map[string]string{
+		"bucket":        "shared",
+		"metadataStore": "context",
+	}))
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	expected = []string{"pvc-1/", "pvc-1/csi-fs/", "pvc-2/csi-fs/"}
+	if objects := store.Objects("shared"); !reflect.DeepEqual(objects, expected) {
+		t.Errorf("expected objects %v, got %v", expected, objects)
+	}
+	volumeContext := resp.GetVolume().GetVolumeContext()
+	contextStore, _ := store.MetaStore(s3.MetaStoreContext, volumeContext)
+	if meta, err := contextStore.GetFSMeta("shared", "pvc-2"); err != nil || meta.Prefix != "pvc-2" || meta.ReclaimPolicy != s3.ReclaimRetain {
+		t.Errorf("expected retained metadata in the volume context, got %+v, %v", meta, err)
+	}
+	// DeleteVolume cannot find the metadata in the volume context
+	if _, err := cs.CreateVolume(context.Background(), createVolumeRequest("pvc-4", map[string]string{
+		"bucket":        "shared",
+		"metadataStore": "context",
+		"reclaimPolicy": "delete-prefix",
+	})); status.Code(err) != codes.InvalidArgument {
+		t.Errorf("expected InvalidArgument for a removable volume in the context store, got %v", err)
+	}
+
+	// volumes without a prefix have no marker
+	if _, err := cs.CreateVolume(context.Background(), createVolumeRequest("pvc-3", map[string]string{
+		"metadataStore": "marker",
+	})); status.Code(err) != codes.InvalidArgument {
+		t.Errorf("expected InvalidArgument, got %v", err)
+	}
+}
+
+func TestCreateVolumeInvalidArguments(t *testing.T) {
+	cs := newTestControllerServer(s3.NewFakeObjectStore())
+	for _, params := range []map[string]string{
+		{"mounter": "s3backer", "fsType": "ntfs"},
+		{"uid": "nobody"},
+		{"fileMode": "rwx"},
+		{"metadataStore": "configmap"},
+		{"bucket": "Shared_Bucket"},
+		{"bucket": "${pvc.namespace}"},
+		{"bucket": "${pvc.uid}", pvcNameKey: "data"},
+		{"bucket": "shared", "prefix": "nested//${pvc.name}", pvcNameKey: "data"},
+		{"reclaimPolicy": "delete"},
+		{"reclaimPolicy": "delete-prefix"},
+		{"bucket": "shared", "reclaimPolicy": "delete-bucket"},
+		{"bucket": "shared", "usePrefix": "true", "prefix": "data", "reclaimPolicy": "delete-prefix"},
+		{"quotaEnforcement": "hard"},
+		{"bucket": "shared", "quotaEnforcement": "bucket-quota"},
+	} {
+		if _, err := cs.CreateVolume(context.Background(), createVolumeRequest("pvc-1", params)); status.Code(err) != codes.InvalidArgument {
+			t.Errorf("expected InvalidArgument for %v, got %v", params, err)
+		}
+	}
+	if _, err := cs.CreateVolume(context.Background(), createVolumeRequest("", nil)); status.Code(err) != codes.InvalidArgument {
+		t.Errorf("expected InvalidArgument for a missing name, got %v", err)
+	}
+}
+
+func TestCreateVolumeTemplates(t *testing.T) {
+	store := s3.NewFakeObjectStore()
+	cs := newTestControllerServer(store)
+	params := map[string]string{
+		"bucket":        "team-${pvc.namespace}",
+		"prefix":        "${pvc.name}",
+		pvcNameKey:      "data",
+		pvcNamespaceKey: "analytics",
+		pvNameKey:       "pvc-1",
+	}
+	resp, err := cs.CreateVolume(context.Background(), createVolumeRequest("pvc-1", params))
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if resp.GetVolume().GetVolumeId() != "v1//team-analytics/data" {
+		t.Errorf("expected volume ID v1//team-analytics/data, got %s", resp.GetVolume().GetVolumeId())
+	}
+	volumeContext := resp.GetVolume().GetVolumeContext()
+	if volumeContext["bucket"] != "team-analytics" || volumeContext["prefix"] != "data" {
+		t.Errorf("expected rendered bucket and prefix in volume context, got %v", volumeContext)
+	}
+	meta, err := store.GetFSMeta("team-analytics", "data")
+	if err != nil {
+		t.Fatalf("expected metadata to be stored: %s", err)
+	}
+	if meta.VolumeName != "pvc-1" || meta.UsePrefix {
+		t.Errorf("unexpected metadata: %+v", meta)
+	}
+
+	// another volume rendering to the same prefix is rejected
+	params[pvNameKey] = "pvc-2"
+	if _, err := cs.CreateVolume(context.Background(), createVolumeRequest("pvc-2", params)); status.Code(err) != codes.AlreadyExists {
+		t.Errorf("expected AlreadyExists for a colliding volume, got %v", err)
+	}
+	// unless it shares the prefix on purpose
+	params["usePrefix"] = "true"
+	if _, err := cs.CreateVolume(context.Background(), createVolumeRequest("pvc-3", params)); err != nil {
+		t.Errorf("unexpected error for a shared prefix: %s", err)
+	}
+}
+
+func TestCreateVolumeErrors(t *testing.T) {
+	store := s3.NewFakeObjectStore()
+	cs := newTestControllerServer(store)
+
+	store.SetError("CreateBucket", errors.New("quota exceeded"))
+	if _, err := cs.CreateVolume(context.Background(), createVolumeRequest("pvc-1", nil)); err == nil {
+		t.Error("expected an error if the bucket cannot be created")
+	}
+	store.SetError("CreateBucket", nil)
+
+	store.SetError("SetFSMeta", s3.ErrFSMetaConflict)
+	if _, err := cs.CreateVolume(context.Background(), createVolumeRequest("pvc-1", nil)); status.Code(err) != codes.Aborted {
+		t.Errorf("expected Aborted for a concurrent metadata update, got %v", err)
+	}
+	store.SetError("SetFSMeta", nil)
+
+	// only missing metadata means the volume has not been created yet
+	store.CreateBucket("pvc-1")
+	store.SetError("GetFSMeta", errors.New("access denied"))
+	if _, err := cs.CreateVolume(context.Background(), createVolumeRequest("pvc-1", nil)); err == nil {
+		t.Error("expected an error if the metadata cannot be read")
+	}
+	if _, err := cs.DeleteVolume(context.Background(), &csi.DeleteVolumeRequest{VolumeId: "v1//pvc-1"}); err == nil {
+		t.Error("expected an error if the metadata cannot be read")
+	}
+}
+
+func TestCreateVolumeNewerMeta(t *testing.T) {
+	store := s3.NewFakeObjectStore()
+	cs := newTestControllerServer(store)
+	store.PutObject("pvc-1", ".metadata.json", []byte(`{"SchemaVersion":99,"Name":"pvc-1","FSPath":"csi-fs","Future":true}`))
+
+	if _, err := cs.CreateVolume(context.Background(), createVolumeRequest("pvc-1", nil)); status.Code(err) != codes.FailedPrecondition {
+		t.Errorf("expected FailedPrecondition for metadata of a newer driver, got %v", err)
+	}
+	meta, err := store.GetFSMeta("pvc-1", "")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if meta.SchemaVersion != 99 {
+		t.Errorf("expected metadata of a newer driver to be kept, got %+v", meta)
+	}
+}
+
+func TestDeleteVolume(t *testing.T) {
+	store := s3.NewFakeObjectStore()
+	cs := newTestControllerServer(store)
+	for _, req := range []*csi.CreateVolumeRequest{
+		createVolumeRequest("pvc-1", nil),
+		createVolumeRequest("pvc-2", map[string]string{"bucket": "shared"}),
+		createVolumeRequest("pvc-3", map[string]string{"bucket": "shared", "metadataStore": "marker"}),
+		createVolumeRequest("pvc-4", map[string]string{"bucket": "data", "usePrefix": "true", "prefix": "existing"}),
+	} {
+		if _, err := cs.CreateVolume(context.Background(), req); err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+	}
+	store.PutObject("shared", "other/file", []byte("data"))
+	store.PutObject("data", "existing/file", []byte("data"))
+
+	// unversioned IDs of earlier releases are still deleted
+	for _, volumeID := range []string{"v1//pvc-1", "shared/pvc-2", "v1//shared/pvc-3", "data/existing", "missing"} {
+		if _, err := cs.DeleteVolume(context.Background(), &csi.DeleteVolumeRequest{VolumeId: volumeID}); err != nil {
+			t.Errorf("unexpected error deleting %s: %s", volumeID, err)
+		}
+	}
+	if exists, _ := store.BucketExists("pvc-1"); exists {
+		t.Error("expected bucket of volume pvc-1 to be removed")
+	}
+	if objects := store.Objects("shared"); !reflect.DeepEqual(objects, []string{"other/file"}) {
+		t.Errorf("expected only the prefixes of the volumes to be removed, got %v", objects)
+	}
+	if objects := store.Objects("data"); len(objects) != 3 {
+		t.Errorf("expected nothing to be removed from an existing prefix, got %v", objects)
+	}
+}
+
+func TestDeleteVolumeGuardrails(t *testing.T) {
+	store := s3.NewFakeObjectStore()
+	cs := newTestControllerServer(store)
+	store.CreateBucket("existing")
+	var volumeIDs []string
+	for _, req := range []*csi.CreateVolumeRequest{
+		createVolumeRequest("existing", nil),
+		createVolumeRequest("pvc-1", nil),
+		createVolumeRequest("pvc-2", map[string]string{"bucket": "shared", "reclaimPolicy": "retain"}),
+	} {
+		resp, err := cs.CreateVolume(context.Background(), req)
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		volumeIDs = append(volumeIDs, resp.GetVolume().GetVolumeId())
+	}
+	store.PutObject("pvc-1", "other/file", []byte("data"))
+
+	// buckets the driver has not created are kept
+	if _, err := cs.DeleteVolume(context.Background(), &csi.DeleteVolumeRequest{VolumeId: volumeIDs[0]}); status.Code(err) != codes.FailedPrecondition {
+		t.Errorf("expected FailedPrecondition for an existing bucket, got %v", err)
+	}
+	if exists, _ := store.BucketExists("existing"); !exists {
+		t.Error("expected existing bucket to be kept")
+	}
+
+	// as are buckets with objects of others
+	if _, err := cs.DeleteVolume(context.Background(), &csi.DeleteVolumeRequest{VolumeId: volumeIDs[1]}); status.Code(err) != codes.FailedPrecondition {
+		t.Errorf("expected FailedPrecondition for a bucket with foreign objects, got %v", err)
+	}
+	if objects := store.Objects("pvc-1"); len(objects) != 3 {
+		t.Errorf("expected nothing to be removed, got %v", objects)
+	}
+	store.RemovePrefix("pvc-1", "other")
+	if _, err := cs.DeleteVolume(context.Background(), &csi.DeleteVolumeRequest{VolumeId: volumeIDs[1]}); err != nil {
+		t.Errorf("unexpected error: %s", err)
+	}
+	if exists, _ := store.BucketExists("pvc-1"); exists {
+		t.Error("expected bucket of volume pvc-1 to be removed")
+	}
+
+	if _, err := cs.DeleteVolume(context.Background(), &csi.DeleteVolumeRequest{VolumeId: volumeIDs[2]}); err != nil {
+		t.Errorf("unexpected error: %s", err)
+	}
+	if _, err := store.GetFSMeta("shared", "pvc-2"); err != nil {
+		t.Errorf("expected retained volume to be kept, got %s", err)
+	}
+}
+
+func TestCreateVolumeRetry(t *testing.T) {
+	store := s3.NewFakeObjectStore()
+	cs := newTestControllerServer(store)
+
+	// a bucket without metadata is not left behind for the retry
+	store.SetError("SetFSMeta", errors.New("unavailable"))
+	if _, err := cs.CreateVolume(context.Background(), createVolumeRequest("pvc-1", nil)); err == nil {
+		t.Fatal("expected an error if the metadata cannot be written")
+	}
+	if exists, _ := store.BucketExists("pvc-1"); exists {
+		t.Error("expected bucket without metadata to be removed")
+	}
+	store.SetError("SetFSMeta", nil)
+
+	resp, err := cs.CreateVolume(context.Background(), createVolumeRequest("pvc-1", nil))
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if meta, err := store.GetFSMeta("pvc-1", ""); err != nil || !meta.BucketCreated {
+		t.Errorf("expected the bucket to be recorded as created by the driver, got %+v, %v", meta, err)
+	}
+	if _, err := cs.DeleteVolume(context.Background(), &csi.DeleteVolumeRequest{VolumeId: resp.GetVolume().GetVolumeId()}); err != nil {
+		t.Errorf("unexpected error: %s", err)
+	}
+	if exists, _ := store.BucketExists("pvc-1"); exists {
+		t.Error("expected bucket of volume pvc-1 to be removed")
+	}
+
+	// failures after the bucket has been recorded keep it for the retry
+	store.SetError("CreatePrefix", errors.New("unavailable"))
+	if _, err := cs.CreateVolume(context.Background(), createVolumeRequest("pvc-2", map[string]string{"bucket": "team"})); err == nil {
+		t.Fatal("expected an error if the prefix cannot be created")
+	}
+	store.SetError("CreatePrefix", nil)
+	resp, err = cs.CreateVolume(context.Background(), createVolumeRequest("pvc-2", map[string]string{"bucket": "team"}))
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if meta, err := store.GetFSMeta("team", "pvc-2"); err != nil || !meta.BucketCreated {
+		t.Errorf("expected the bucket to be recorded as created by the driver, got %+v, %v", meta, err)
+	}
+}
+
+func TestDeleteVolumeNestedPrefix(t *testing.T) {
+	store := s3.NewFakeObjectStore()
+	cs := newTestControllerServer(store)
+	var volumeIDs []string
+	for i, prefix := range []string{"${pvc.namespace}", "${pvc.namespace}/app/${pvc.name}", "${pvc.namespace}-2"} {
+		resp, err := cs.CreateVolume(context.Background(), createVolumeRequest(fmt.Sprintf("pvc-%d", i), map[string]string{
+			"bucket":        "shared",
+			"prefix":        prefix,
+			pvcNamespaceKey: "team",
+			pvcNameKey:      "data",
+		}))
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		volumeIDs = append(volumeIDs, resp.GetVolume().GetVolumeId())
+	}
+	if volumeIDs[1] != "v1//shared/team/app/data" {
+		t.Errorf("expected volume ID v1//shared/team/app/data, got %s", volumeIDs[1])
+	}
+
+	if _, err := cs.DeleteVolume(context.Background(), &csi.DeleteVolumeRequest{VolumeId: volumeIDs[1]}); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if _, err := store.GetFSMeta("shared", "team/app/data"); err != s3.ErrFSMetaNotFound {
+		t.Errorf("expected nested prefix to be removed, got %v", err)
+	}
+	if _, err := cs.DeleteVolume(context.Background(), &csi.DeleteVolumeRequest{VolumeId: volumeIDs[0]}); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if _, err := store.GetFSMeta("shared", "team-2"); err != nil {
+		t.Errorf("expected prefix next to the removed one to be kept, got %s", err)
+	}
+}
+
+func TestDeleteVolumeMismatchingMeta(t *testing.T) {
+	store := s3.NewFakeObjectStore()
+	cs := newTestControllerServer(store)
+	// metadata copied to another prefix still describes the original volume
+	store.PutObject("shared", "copy/file", []byte("data"))
+	store.PutObject("shared", "copy/.metadata.json", []byte(`{"Name":"shared","Prefix":"pvc-1","FSPath":"csi-fs"}`))
+
+	if _, err := cs.DeleteVolume(context.Background(), &csi.DeleteVolumeRequest{VolumeId: "v1//shared/copy"}); status.Code(err) != codes.FailedPrecondition {
+		t.Errorf("expected FailedPrecondition for mismatching metadata, got %v", err)
+	}
+	if objects := store.Objects("shared"); len(objects) != 2 {
+		t.Errorf("expected nothing to be removed, got %v", objects)
+	}
+}
+
+func TestVolumeWithProfile(t *testing.T) {
+	cfg := config.Default()
+	cfg.Profiles = map[string]config.Profile{
+		"minio": {Endpoint: "https://minio:9000", DefaultMounter: "rclone"},
+	}
+	defer config.Set(config.Get())
+	config.Set(cfg)
+
+	store := s3.NewFakeObjectStore()
+	var endpoints []string
+	cs := newTestControllerServer(store)
+	cs.newClient = func(cfg *s3.Config) (s3.ObjectStore, error) {
+		endpoints = append(endpoints, cfg.Endpoint)
+		return store, nil
+	}
+	secrets := map[string]string{"accessKeyID": "key", "secretAccessKey": "secret", "endpoint": "https://s3.amazonaws.com"}
+
+	req := createVolumeRequest("pvc-1", map[string]string{"profile": "minio", "bucket": "shared"})
+	req.Secrets = secrets
+	resp, err := cs.CreateVolume(context.Background(), req)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if resp.GetVolume().GetVolumeId() != "v1/minio/shared/pvc-1" {
+		t.Errorf("expected volume ID v1/minio/shared/pvc-1, got %s", resp.GetVolume().GetVolumeId())
+	}
+	meta, err := store.GetFSMeta("shared", "pvc-1")
+	if err != nil {
+		t.Fatalf("expected metadata to be stored: %s", err)
+	}
+	if meta.Profile != "minio" || meta.Mounter != "rclone" {
+		t.Errorf("expected profile and its default mounter in metadata, got %+v", meta)
+	}
+
+	if _, err := cs.DeleteVolume(context.Background(), &csi.DeleteVolumeRequest{VolumeId: resp.GetVolume().GetVolumeId(), Secrets: secrets}); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if _, err := store.GetFSMeta("shared", "pvc-1"); err != s3.ErrFSMetaNotFound {
+		t.Errorf("expected volume to be removed, got %v", err)
+	}
+	if !reflect.DeepEqual(endpoints, []string{"https://minio:9000", "https://minio:9000"}) {
+		t.Errorf("expected the endpoint of the profile to be used, got %v", endpoints)
+	}
+
+	// profiles which are set without loading the config are checked as well
+	cfg.Profiles["a/b"] = config.Profile{Endpoint: "https://minio:9000"}
+	req = createVolumeRequest("pvc-2", map[string]string{"profile": "a/b"})
+	req.Secrets = secrets
+	if _, err := cs.CreateVolume(context.Background(), req); status.Code(err) != codes.InvalidArgument {
+		t.Errorf("expected InvalidArgument for profile name with a slash, got %v", err)
+	}
+
+	req = createVolumeRequest("pvc-2", map[string]string{"profile": "unknown"})
+	if _, err := cs.CreateVolume(context.Background(), req); status.Code(err) != codes.InvalidArgument {
+		t.Errorf("expected InvalidArgument for unknown profile, got %v", err)
+	}
+	if _, err := cs.DeleteVolume(context.Background(), &csi.DeleteVolumeRequest{VolumeId: "v1/unknown/pvc-2"}); status.Code(err) != codes.InvalidArgument {
+		t.Errorf("expected InvalidArgument for unknown profile, got %v", err)
+	}
+}
+
+func TestDeleteVolumeRestoresMeta(t *testing.T) {
+	store := s3.NewFakeObjectStore()
+	cs := newTestControllerServer(store)
+	if _, err := cs.CreateVolume(context.Background(), createVolumeRequest("pvc-1", nil)); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	store.SetError("RemoveBucket", errors.New("access denied"))
+	if _, err := cs.DeleteVolume(context.Background(), &csi.DeleteVolumeRequest{VolumeId: "pvc-1"}); err == nil {
+		t.Fatal("expected an error if the bucket cannot be removed")
+	}
+	if _, err := store.GetFSMeta("pvc-1", ""); err != nil {
+		t.Errorf("expected metadata to be kept, got %s", err)
+	}
+}
+
+func TestValidateVolumeCapabilities(t *testing.T) {
+	store := s3.NewFakeObjectStore()
+	cs := newTestControllerServer(store)
+	resp, err := cs.CreateVolume(context.Background(), createVolumeRequest("pvc-1", nil))
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	store.PutObject("no-meta", "file", []byte("data"))
+
+	validate := func(volumeID string, mode csi.VolumeCapability_AccessMode_Mode) (*csi.ValidateVolumeCapabilitiesResponse, error) {
+		return cs.ValidateVolumeCapabilities(context.Background(), &csi.ValidateVolumeCapabilitiesRequest{
+			VolumeId:      volumeID,
+			VolumeContext: resp.GetVolume().GetVolumeContext(),
+			VolumeCapabilities: []*csi.VolumeCapability{{
+				AccessMode: &csi.VolumeCapability_AccessMode{Mode: mode},
+			}},
+		})
+	}
+	if res, err := validate("pvc-1", csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER); err != nil || res.GetConfirmed() == nil {
+		t.Errorf("expected capabilities to be confirmed, got %v, %v", res, err)
+	}
+	if res, err := validate("pvc-1", csi.VolumeCapability_AccessMode_MULTI_NODE_MULTI_WRITER); err != nil || res.GetConfirmed() != nil {
+		t.Errorf("expected capabilities not to be confirmed, got %v, %v", res, err)
+	}
+	for _, volumeID := range []string{"missing", "no-meta"} {
+		if _, err := validate(volumeID, csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER); status.Code(err) != codes.NotFound {
+			t.Errorf("expected NotFound for %s, got %v", volumeID, err)
+		}
+	}
+}
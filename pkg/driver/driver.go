@@ -17,8 +17,19 @@ limitations under the License.
 package driver
 
 import (
+	"errors"
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+
 	"github.com/container-storage-interface/spec/lib/go/csi"
-	"github.com/golang/glog"
+	"github.com/ctrox/csi-s3/pkg/config"
+	"github.com/ctrox/csi-s3/pkg/kube"
+	"github.com/ctrox/csi-s3/pkg/logging"
+	"github.com/ctrox/csi-s3/pkg/metrics"
+	"github.com/ctrox/csi-s3/pkg/mounter"
+	"k8s.io/mount-utils"
 
 	csicommon "github.com/kubernetes-csi/drivers/pkg/csi-common"
 )
@@ -26,6 +37,8 @@ import (
 type driver struct {
 	driver   *csicommon.CSIDriver
 	endpoint string
+	state    *nodeState
+	cfg      *Config
 
 	ids *identityServer
 	ns  *nodeServer
@@ -37,52 +50,214 @@ var (
 	driverName    = "ch.ctrox.csi.s3-driver"
 )
 
+const (
+	// ModeController only runs the identity and controller services
+	ModeController = "controller"
+	// ModeNode only runs the identity and node services
+	ModeNode = "node"
+	// ModeAll runs all services
+	ModeAll = "all"
+	// ModeMounter runs the mounter daemon instead of any CSI service,
+	// see mounter.ServeDaemon
+	ModeMounter = "mounter"
+)
+
+// Version returns the version of the driver
+func Version() string {
+	return vendorVersion
+}
+
+// Config holds the options of the driver
+type Config struct {
+	NodeID   string
+	Endpoint string
+	// Mode selects which services are run, defaults to ModeAll
+	Mode string
+	// DriverName overrides the default name of the driver
+	DriverName string
+	// DefaultMounter is used for volumes which do not specify a mounter
+	DefaultMounter string
+	// MounterSocket is the socket of the mounter daemon, if it is set the
+	// FUSE processes of staged volumes run in the daemon instead of the driver
+	MounterSocket string
+	// StateDir is where the state of staged volumes on this node is persisted
+	StateDir string
+	// ProbeMounters are the mounters Probe checks to be usable on this node
+	ProbeMounters []string
+	// ProbeEndpoint is an optional S3 endpoint Probe checks connectivity to
+	ProbeEndpoint string
+}
+
 // New initializes the driver
-func New(nodeID string, endpoint string) (*driver, error) {
-	d := csicommon.NewCSIDriver(driverName, vendorVersion, nodeID)
+func New(cfg *Config) (*driver, error) {
+	switch cfg.Mode {
+	case "":
+		cfg.Mode = ModeAll
+	case ModeController, ModeNode, ModeAll:
+	default:
+		return nil, fmt.Errorf("unknown mode %s, must be one of %s, %s, %s", cfg.Mode, ModeController, ModeNode, ModeAll)
+	}
+	if cfg.DriverName == "" {
+		cfg.DriverName = driverName
+	}
+	if cfg.DefaultMounter != "" && !mounter.IsSupported(cfg.DefaultMounter) {
+		return nil, fmt.Errorf("unknown default mounter %s", cfg.DefaultMounter)
+	}
+
+	d := csicommon.NewCSIDriver(cfg.DriverName, vendorVersion, cfg.NodeID)
 	if d == nil {
-		glog.Fatalln("Failed to initialize CSI Driver.")
+		return nil, errors.New("failed to initialize CSI driver")
 	}
 
 	s3Driver := &driver{
-		endpoint: endpoint,
+		endpoint: cfg.Endpoint,
 		driver:   d,
+		cfg:      cfg,
+	}
+
+	if s3Driver.runsNode() {
+		state, err := newNodeState(cfg.StateDir)
+		if err != nil {
+			return nil, err
+		}
+		s3Driver.state = state
+		if cfg.MounterSocket != "" {
+			mounter.UseDaemon(cfg.MounterSocket)
+		}
 	}
 	return s3Driver, nil
 }
 
+// defaultMounter returns override if it is set
+// or the default mounter of the configuration
+func defaultMounter(override string) string {
+	if override != "" {
+		return override
+	}
+	return config.Get().DefaultMounter
+}
+
+// ValidateConfig checks the driver specific settings of cfg
+func ValidateConfig(cfg *config.Config) error {
+	if cfg.DefaultMounter != "" && !mounter.IsSupported(cfg.DefaultMounter) {
+		return fmt.Errorf("unknown default mounter %s", cfg.DefaultMounter)
+	}
+	for _, m := range cfg.AllowedMounters {
+		if !mounter.IsSupported(m) {
+			return fmt.Errorf("unknown allowed mounter %s", m)
+		}
+	}
+	for name, p := range cfg.Profiles {
+		if p.DefaultMounter != "" && !mounter.IsSupported(p.DefaultMounter) {
+			return fmt.Errorf("unknown default mounter %s of profile %s", p.DefaultMounter, name)
+		}
+	}
+	return nil
+}
+
+func (s3 *driver) runsController() bool {
+	return s3.cfg.Mode == ModeController || s3.cfg.Mode == ModeAll
+}
+
+func (s3 *driver) runsNode() bool {
+	return s3.cfg.Mode == ModeNode || s3.cfg.Mode == ModeAll
+}
+
 func (s3 *driver) newIdentityServer(d *csicommon.CSIDriver) *identityServer {
 	return &identityServer{
 		DefaultIdentityServer: csicommon.NewDefaultIdentityServer(d),
+		mounters:              s3.cfg.ProbeMounters,
+		probeEndpoint:         s3.cfg.ProbeEndpoint,
+		controller:            s3.runsController(),
 	}
 }
 
 func (s3 *driver) newControllerServer(d *csicommon.CSIDriver) *controllerServer {
 	return &controllerServer{
 		DefaultControllerServer: csicommon.NewDefaultControllerServer(d),
+		driverName:              s3.cfg.DriverName,
+		defaultMounter:          s3.cfg.DefaultMounter,
+		locks:                   newOperationLocks(),
+		newClient:               newObjectStore,
 	}
 }
 
 func (s3 *driver) newNodeServer(d *csicommon.CSIDriver) *nodeServer {
 	return &nodeServer{
 		DefaultNodeServer: csicommon.NewDefaultNodeServer(d),
+		state:             s3.state,
+		defaultMounter:    s3.cfg.DefaultMounter,
+		locks:             newOperationLocks(),
+		mounts:            mount.New(""),
+		newMounter:        mounter.New,
+		newClient:         newObjectStore,
 	}
 }
 
 func (s3 *driver) Run() {
-	glog.Infof("Driver: %v ", driverName)
-	glog.Infof("Version: %v ", vendorVersion)
+	logging.InfoS("starting driver", "driver", s3.cfg.DriverName, "version", vendorVersion, "mode", s3.cfg.Mode)
 	// Initialize default library driver
 
-	s3.driver.AddControllerServiceCapabilities([]csi.ControllerServiceCapability_RPC_Type{csi.ControllerServiceCapability_RPC_CREATE_DELETE_VOLUME})
 	s3.driver.AddVolumeCapabilityAccessModes([]csi.VolumeCapability_AccessMode_Mode{csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER})
 
-	// Create GRPC servers
+	// stop is closed when the driver shuts down
+	stop := make(chan struct{})
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, syscall.SIGINT)
+	defer signal.Stop(signals)
+
+	// Create GRPC servers, services which do not run
+	// in this mode are not registered at all
 	s3.ids = s3.newIdentityServer(s3.driver)
-	s3.ns = s3.newNodeServer(s3.driver)
-	s3.cs = s3.newControllerServer(s3.driver)
+	var cs csi.ControllerServer
+	var ns csi.NodeServer
+	if s3.runsController() {
+		s3.driver.AddControllerServiceCapabilities([]csi.ControllerServiceCapability_RPC_Type{csi.ControllerServiceCapability_RPC_CREATE_DELETE_VOLUME})
+		s3.cs = s3.newControllerServer(s3.driver)
+		cs = s3.cs
+		if kc, err := kube.InClusterClient(); err == nil {
+			s3.cs.kube = kc
+			go s3.cs.runUsage(stop)
+		} else {
+			logging.InfoS("the usage of volumes is not measured", "reason", err.Error())
+		}
+	}
+	if s3.runsNode() {
+		s3.ns = s3.newNodeServer(s3.driver)
+		ns = s3.ns
+		s3.ns.initActiveMounts()
+		go s3.ns.runStateGC(stop)
+	}
+
+	s := newNonBlockingGRPCServer(metrics.UnaryServerInterceptor)
+	s.Start(s3.endpoint, s3.ids, cs, ns)
+
+	served := make(chan struct{})
+	go func() {
+		s.Wait()
+		close(served)
+	}()
+
+	select {
+	case <-served:
+		close(stop)
+	case sig := <-signals:
+		logging.InfoS("shutting down", "signal", sig.String())
+		close(stop)
+		s3.shutdown(s)
+	}
+}
 
-	s := csicommon.NewNonBlockingGRPCServer()
-	s.Start(s3.endpoint, s3.ids, s3.cs, s3.ns)
-	s.Wait()
+// shutdown stops the server after in-flight calls are done and
+// reports which mounts outlive the driver process
+func (s3 *driver) shutdown(s *nonBlockingGRPCServer) {
+	if s.Shutdown(config.Get().ShutdownTimeout.Duration) {
+		logging.InfoS("all in-flight calls finished")
+	}
+	if s3.runsNode() {
+		if err := s3.state.flush(); err != nil {
+			logging.ErrorS(err, "failed to flush state")
+		}
+		s3.ns.reportMounts()
+	}
 }
@@ -0,0 +1,135 @@
+package driver
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/ctrox/csi-s3/pkg/config"
+	"github.com/ctrox/csi-s3/pkg/logging"
+	"github.com/ctrox/csi-s3/pkg/metrics"
+	"github.com/ctrox/csi-s3/pkg/mounter"
+	"github.com/ctrox/csi-s3/pkg/s3"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	// ephemeralKey is set by kubelet in the volume context
+	// of CSI ephemeral inline volumes
+	ephemeralKey = "csi.storage.k8s.io/ephemeral"
+	// ephemeralStagingDir is created next to the target path of an
+	// ephemeral volume, kubelet does not stage ephemeral volumes.
+	ephemeralStagingDir = "staging"
+)
+
+func isEphemeral(volumeContext map[string]string) bool {
+	return volumeContext[ephemeralKey] == "true"
+}
+
+// ephemeralStagingPath returns the path the FUSE process of an ephemeral volume
+// is mounted at. It is within the pod volume directory so it is visible to
+// the mounter daemon and removed together with the pod.
+func ephemeralStagingPath(targetPath string) string {
+	return filepath.Join(filepath.Dir(targetPath), ephemeralStagingDir)
+}
+
+// publishEphemeral mounts the bucket of an ephemeral inline volume
+// to the target path. The credentials are taken from the node publish
+// secret of the volume.
+func (ns *nodeServer) publishEphemeral(req *csi.NodePublishVolumeRequest) error {
+	volumeID := req.GetVolumeId()
+	targetPath := req.GetTargetPath()
+	stagingPath := ephemeralStagingPath(targetPath)
+
+	// the bucket is mounted as is, there is no metadata stored in it
+	meta, err := metaFromVolumeContext(req.GetVolumeContext(), "", "")
+	if err != nil {
+		return status.Error(codes.InvalidArgument, err.Error())
+	}
+	cfg, err := ns.s3Config(req.GetSecrets(), meta.Profile)
+	if err != nil {
+		return err
+	}
+	mounterType := mounter.Type(meta, cfg)
+	if !mounter.SupportsEphemeral(mounterType) {
+		return status.Error(codes.InvalidArgument, fmt.Sprintf("mounter %s does not support ephemeral volumes", mounterType))
+	}
+	if !config.Get().IsMounterAllowed(mounterType) {
+		return status.Error(codes.InvalidArgument, fmt.Sprintf("Mounter %s is not allowed", mounterType))
+	}
+	meta.Mounter = mounterType
+	mounter.SetMountGroup(meta, req.GetVolumeCapability().GetMount().GetVolumeMountGroup())
+
+	logging.V(4).InfoS("publishing ephemeral volume", "target", targetPath, "volumeID", volumeID,
+		"bucket", meta.BucketName, "prefix", meta.Prefix, "mounter", mounterType)
+
+	m, err := ns.newMounter(meta, cfg)
+	if err != nil {
+		return err
+	}
+	notMnt, err := ns.checkMount(stagingPath)
+	if err != nil {
+		return status.Error(codes.Internal, err.Error())
+	}
+	if notMnt {
+		if err := m.Stage(stagingPath); err != nil {
+			return err
+		}
+		metrics.ActiveMounts.WithLabelValues(mounterType).Inc()
+	}
+	vs := &volumeState{
+		VolumeID:          volumeID,
+		StagingTargetPath: stagingPath,
+		Meta:              meta,
+		TargetPaths:       []string{targetPath},
+		Ephemeral:         true,
+	}
+	if err := ns.state.save(vs); err != nil {
+		ns.cleanupEphemeral(vs)
+		return status.Error(codes.Internal, err.Error())
+	}
+	if err := m.Mount(stagingPath, targetPath, req.GetReadonly()); err != nil {
+		// kubelet does not unpublish volumes which failed to publish
+		ns.cleanupEphemeral(vs)
+		return err
+	}
+	logging.V(4).InfoS("ephemeral volume mounted", "volumeID", volumeID, "target", targetPath)
+	return nil
+}
+
+// cleanupEphemeral tears down the staging mount of an ephemeral volume
+// which could not be published
+func (ns *nodeServer) cleanupEphemeral(vs *volumeState) {
+	if err := ns.unpublishEphemeral(vs); err != nil {
+		logging.ErrorS(err, "failed to clean up ephemeral volume", "volumeID", vs.VolumeID)
+	}
+}
+
+// unpublishEphemeral tears down the staging mount of an ephemeral volume
+// after its target path has been unmounted
+func (ns *nodeServer) unpublishEphemeral(vs *volumeState) error {
+	mounted, err := ns.isMountPoint(vs.StagingTargetPath)
+	if err != nil {
+		return err
+	}
+	if mounted {
+		m, err := ns.newMounter(vs.Meta, &s3.Config{Mounter: defaultMounter(ns.defaultMounter)})
+		if err != nil {
+			return err
+		}
+		if err := m.Unstage(vs.StagingTargetPath); err != nil {
+			return err
+		}
+	}
+	if err := os.Remove(vs.StagingTargetPath); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if err := ns.state.remove(vs.VolumeID); err != nil {
+		return err
+	}
+	metrics.ActiveMounts.WithLabelValues(vs.Meta.Mounter).Dec()
+	logging.V(4).InfoS("ephemeral volume removed", "volumeID", vs.VolumeID)
+	return nil
+}
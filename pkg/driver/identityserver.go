@@ -17,9 +17,116 @@ limitations under the License.
 package driver
 
 import (
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/ctrox/csi-s3/pkg/logging"
+	"github.com/ctrox/csi-s3/pkg/mounter"
+	"github.com/golang/protobuf/ptypes/wrappers"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
 	csicommon "github.com/kubernetes-csi/drivers/pkg/csi-common"
 )
 
+const (
+	fuseDevice           = "/dev/fuse"
+	probeEndpointTimeout = 5 * time.Second
+)
+
 type identityServer struct {
 	*csicommon.DefaultIdentityServer
+	mounters      []string
+	probeEndpoint string
+	controller    bool
+}
+
+// GetPluginCapabilities only advertises the controller service if it runs
+func (ids *identityServer) GetPluginCapabilities(ctx context.Context, req *csi.GetPluginCapabilitiesRequest) (*csi.GetPluginCapabilitiesResponse, error) {
+	capabilities := []*csi.PluginCapability{}
+	if ids.controller {
+		capabilities = append(capabilities, &csi.PluginCapability{
+			Type: &csi.PluginCapability_Service_{
+				Service: &csi.PluginCapability_Service{
+					Type: csi.PluginCapability_Service_CONTROLLER_SERVICE,
+				},
+			},
+		})
+	}
+	return &csi.GetPluginCapabilitiesResponse{Capabilities: capabilities}, nil
+}
+
+// probeCheck is a failed check of Probe
+type probeCheck struct {
+	component string
+	err       error
+}
+
+// Probe reports the plugin as ready only if all configured mounters
+// and the optional probe endpoint are usable. Failed checks are logged
+// and returned as FailedPrecondition naming the failing components.
+func (ids *identityServer) Probe(ctx context.Context, req *csi.ProbeRequest) (*csi.ProbeResponse, error) {
+	failed := ids.checkMounters()
+	if ids.probeEndpoint != "" {
+		if err := checkEndpoint(ctx, ids.probeEndpoint); err != nil {
+			failed = append(failed, probeCheck{component: "endpoint", err: err})
+		}
+	}
+
+	if len(failed) > 0 {
+		problems := make([]string, 0, len(failed))
+		for _, c := range failed {
+			logging.ErrorS(c.err, "probe check failed", "component", c.component)
+			problems = append(problems, fmt.Sprintf("%s: %s", c.component, c.err))
+		}
+		return nil, status.Error(codes.FailedPrecondition, fmt.Sprintf("probe failed: %s", strings.Join(problems, "; ")))
+	}
+	return &csi.ProbeResponse{Ready: &wrappers.BoolValue{Value: true}}, nil
+}
+
+func (ids *identityServer) checkMounters() []probeCheck {
+	failed := []probeCheck{}
+	if len(ids.mounters) == 0 {
+		return failed
+	}
+	if _, err := os.Stat(fuseDevice); err != nil {
+		failed = append(failed, probeCheck{component: "fuse", err: fmt.Errorf("fuse device is not available: %s", err)})
+	}
+	for _, m := range ids.mounters {
+		version, err := mounter.Check(m)
+		if err != nil {
+			failed = append(failed, probeCheck{component: "mounter " + m, err: err})
+			continue
+		}
+		logging.V(5).InfoS("probe found mounter", "mounter", m, "version", version)
+	}
+	return failed
+}
+
+// checkEndpoint checks that a tcp connection to the S3 endpoint can be established
+func checkEndpoint(ctx context.Context, endpoint string) error {
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return fmt.Errorf("invalid probe endpoint %s: %s", endpoint, err)
+	}
+	port := u.Port()
+	if port == "" {
+		port = "80"
+		if u.Scheme == "https" {
+			port = "443"
+		}
+	}
+	ctx, cancel := context.WithTimeout(ctx, probeEndpointTimeout)
+	defer cancel()
+	conn, err := (&net.Dialer{}).DialContext(ctx, "tcp", net.JoinHostPort(u.Hostname(), port))
+	if err != nil {
+		return fmt.Errorf("endpoint %s is not reachable: %s", endpoint, err)
+	}
+	return conn.Close()
 }
@@ -0,0 +1,36 @@
+package driver
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestProbe(t *testing.T) {
+	ids := &identityServer{}
+	resp, err := ids.Probe(context.Background(), &csi.ProbeRequest{})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if !resp.GetReady().GetValue() {
+		t.Errorf("expected probe without checks to be ready")
+	}
+
+	ids = &identityServer{
+		mounters:      []string{"unknown"},
+		probeEndpoint: "http://127.0.0.1:0",
+	}
+	_, err = ids.Probe(context.Background(), &csi.ProbeRequest{})
+	if status.Code(err) != codes.FailedPrecondition {
+		t.Fatalf("expected code %s, got %v", codes.FailedPrecondition, err)
+	}
+	for _, component := range []string{"mounter unknown:", "endpoint:"} {
+		if !strings.Contains(err.Error(), component) {
+			t.Errorf("expected %q to name the failed check %q", err, component)
+		}
+	}
+}
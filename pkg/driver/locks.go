@@ -0,0 +1,67 @@
+package driver
+
+import (
+	"sync"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func volumeLockKey(volumeID string) string {
+	return "volume:" + volumeID
+}
+
+func pathLockKey(path string) string {
+	return "path:" + path
+}
+
+// operationLocks keeps track of in-flight operations per key so
+// concurrent retries of the same operation can be rejected
+type operationLocks struct {
+	mu    sync.Mutex
+	locks map[string]struct{}
+}
+
+func newOperationLocks() *operationLocks {
+	return &operationLocks{
+		locks: map[string]struct{}{},
+	}
+}
+
+// tryAcquire locks all keys and returns true, or returns false
+// without locking any key if one of them is already locked
+func (l *operationLocks) tryAcquire(keys ...string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for _, key := range keys {
+		if _, ok := l.locks[key]; ok {
+			return false
+		}
+	}
+	for _, key := range keys {
+		l.locks[key] = struct{}{}
+	}
+	return true
+}
+
+// lockVolume locks the volume and the paths an operation works on, it
+// returns an Aborted error if another operation holds any of the locks
+func (l *operationLocks) lockVolume(volumeID string, paths ...string) (release func(), err error) {
+	keys := []string{volumeLockKey(volumeID)}
+	for _, p := range paths {
+		keys = append(keys, pathLockKey(p))
+	}
+	if !l.tryAcquire(keys...) {
+		return nil, status.Errorf(codes.Aborted, "an operation for volume %s is already in progress", volumeID)
+	}
+	return func() { l.release(keys...) }, nil
+}
+
+// release unlocks all keys
+func (l *operationLocks) release(keys ...string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for _, key := range keys {
+		delete(l.locks, key)
+	}
+}
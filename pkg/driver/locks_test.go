@@ -0,0 +1,36 @@
+package driver
+
+import (
+	"testing"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestOperationLocks(t *testing.T) {
+	locks := newOperationLocks()
+
+	release, err := locks.lockVolume("vol", "/target-1")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	// same volume is locked regardless of the path
+	if _, err := locks.lockVolume("vol", "/target-2"); status.Code(err) != codes.Aborted {
+		t.Errorf("expected Aborted for locked volume, got %v", err)
+	}
+	// same path is locked for other volumes
+	if _, err := locks.lockVolume("other", "/target-1"); status.Code(err) != codes.Aborted {
+		t.Errorf("expected Aborted for locked path, got %v", err)
+	}
+	// a failed attempt must not keep any of its locks
+	releaseOther, err := locks.lockVolume("other", "/target-2")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	releaseOther()
+
+	release()
+	if _, err := locks.lockVolume("vol", "/target-1"); err != nil {
+		t.Errorf("expected lock to be released, got %v", err)
+	}
+}
@@ -0,0 +1,105 @@
+package driver
+
+import (
+	"fmt"
+	"net"
+	"regexp"
+	"strings"
+)
+
+const (
+	// pvcNameKey, pvcNamespaceKey and pvNameKey are added to the parameters
+	// of CreateVolume by the external-provisioner with --extra-create-metadata
+	pvcNameKey      = "csi.storage.k8s.io/pvc/name"
+	pvcNamespaceKey = "csi.storage.k8s.io/pvc/namespace"
+	pvNameKey       = "csi.storage.k8s.io/pv/name"
+	// maxPrefixLength leaves room for the fsPath and object names
+	// within the 1024 byte limit of S3 object keys
+	maxPrefixLength = 512
+)
+
+// templateVariables are the placeholders of bucket and prefix
+// templates and the parameters they are replaced with
+var templateVariables = map[string]string{
+	"pvc.name":      pvcNameKey,
+	"pvc.namespace": pvcNamespaceKey,
+	"pv.name":       pvNameKey,
+}
+
+var (
+	templateRegexp   = regexp.MustCompile(`\$\{([^}]*)\}`)
+	bucketNameRegexp = regexp.MustCompile(`^[a-z0-9][a-z0-9.-]*[a-z0-9]$`)
+)
+
+// isTemplate returns true if tmpl contains placeholders
+func isTemplate(tmpl string) bool {
+	return strings.Contains(tmpl, "${")
+}
+
+// renderTemplate replaces the placeholders like ${pvc.namespace}
+// in tmpl with the values of params
+func renderTemplate(tmpl string, params map[string]string) (string, error) {
+	var err error
+	rendered := templateRegexp.ReplaceAllStringFunc(tmpl, func(placeholder string) string {
+		name := templateRegexp.FindStringSubmatch(placeholder)[1]
+		key, ok := templateVariables[name]
+		if !ok {
+			err = fmt.Errorf("unknown variable %s in %q, must be one of pvc.name, pvc.namespace or pv.name", placeholder, tmpl)
+			return ""
+		}
+		value := params[key]
+		if value == "" {
+			err = fmt.Errorf("%s is not set, the external-provisioner has to run with --extra-create-metadata", key)
+		}
+		return value
+	})
+	if err != nil {
+		return "", err
+	}
+	if strings.Contains(rendered, "${") {
+		return "", fmt.Errorf("unterminated variable in %q", tmpl)
+	}
+	return rendered, nil
+}
+
+// validateBucketName returns an error if name violates the
+// naming rules of S3 buckets
+func validateBucketName(name string) error {
+	if len(name) < 3 || len(name) > 63 {
+		return fmt.Errorf("bucket name %q must be between 3 and 63 characters long", name)
+	}
+	if !bucketNameRegexp.MatchString(name) {
+		return fmt.Errorf("bucket name %q must consist of lower case letters, numbers, dots and hyphens and begin and end with a letter or number", name)
+	}
+	if strings.Contains(name, "..") {
+		return fmt.Errorf("bucket name %q must not contain adjacent dots", name)
+	}
+	if net.ParseIP(name) != nil {
+		return fmt.Errorf("bucket name %q must not be formatted as an IP address", name)
+	}
+	if strings.HasPrefix(name, "xn--") || strings.HasSuffix(name, "-s3alias") {
+		return fmt.Errorf("bucket name %q must not begin with xn-- or end with -s3alias", name)
+	}
+	return nil
+}
+
+// validatePrefix returns an error if prefix cannot be used as the
+// prefix of a volume within a bucket
+func validatePrefix(prefix string) error {
+	if len(prefix) > maxPrefixLength {
+		return fmt.Errorf("prefix %q must be at most %d characters long", prefix, maxPrefixLength)
+	}
+	if prefix == "" {
+		return nil
+	}
+	// nested prefixes are fine, but every element must name a directory
+	for _, element := range strings.Split(prefix, "/") {
+		if element == "" {
+			return fmt.Errorf("prefix %q must not begin or end with / or contain //", prefix)
+		}
+		if element == "." || element == ".." {
+			return fmt.Errorf("prefix %q must not contain . or .. elements", prefix)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,77 @@
+package driver
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestRenderTemplate(t *testing.T) {
+	params := map[string]string{
+		pvcNameKey:      "data",
+		pvcNamespaceKey: "analytics",
+		pvNameKey:       "pvc-1234",
+	}
+	for tmpl, want := range map[string]string{
+		"":                                  "",
+		"static":                            "static",
+		"${pvc.namespace}-${pvc.name}":      "analytics-data",
+		"team-${pvc.namespace}":             "team-analytics",
+		"${pv.name}":                        "pvc-1234",
+		"${pvc.name}${pvc.name}-${pv.name}": "datadata-pvc-1234",
+	} {
+		got, err := renderTemplate(tmpl, params)
+		if err != nil {
+			t.Errorf("unexpected error rendering %q: %s", tmpl, err)
+			continue
+		}
+		if got != want {
+			t.Errorf("renderTemplate(%q) = %q, want %q", tmpl, got, want)
+		}
+	}
+	for _, tmpl := range []string{"${pvc.uid}", "${pvc.name", "${}"} {
+		if _, err := renderTemplate(tmpl, params); err == nil {
+			t.Errorf("expected error rendering %q", tmpl)
+		}
+	}
+	if _, err := renderTemplate("${pvc.name}", nil); err == nil {
+		t.Error("expected error without pvc metadata")
+	}
+}
+
+func TestValidateBucketName(t *testing.T) {
+	for _, name := range []string{"abc", "my-bucket", "my.bucket.1", strings.Repeat("a", 63)} {
+		if err := validateBucketName(name); err != nil {
+			t.Errorf("unexpected error for %q: %s", name, err)
+		}
+	}
+	for _, name := range []string{
+		"",
+		"ab",
+		strings.Repeat("a", 64),
+		"My-Bucket",
+		"my_bucket",
+		"-bucket",
+		"bucket.",
+		"my..bucket",
+		"192.168.1.1",
+		"xn--bucket",
+		"bucket-s3alias",
+	} {
+		if err := validateBucketName(name); err == nil {
+			t.Errorf("expected error for %q", name)
+		}
+	}
+}
+
+func TestValidatePrefix(t *testing.T) {
+	for _, prefix := range []string{"", "pvc-1", "My_Prefix.data", "team/app/data"} {
+		if err := validatePrefix(prefix); err != nil {
+			t.Errorf("unexpected error for %q: %s", prefix, err)
+		}
+	}
+	for _, prefix := range []string{"/a", "a/", "a//b", ".", "..", "a/../b", strings.Repeat("a", maxPrefixLength+1)} {
+		if err := validatePrefix(prefix); err == nil {
+			t.Errorf("expected error for %q", prefix)
+		}
+	}
+}
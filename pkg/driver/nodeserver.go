@@ -19,10 +19,13 @@ package driver
 import (
 	"fmt"
 	"os"
+	"time"
 
+	"github.com/ctrox/csi-s3/pkg/config"
+	"github.com/ctrox/csi-s3/pkg/logging"
+	"github.com/ctrox/csi-s3/pkg/metrics"
 	"github.com/ctrox/csi-s3/pkg/mounter"
 	"github.com/ctrox/csi-s3/pkg/s3"
-	"github.com/golang/glog"
 	"golang.org/x/net/context"
 
 	"github.com/container-storage-interface/spec/lib/go/csi"
@@ -35,13 +38,21 @@ import (
 
 type nodeServer struct {
 	*csicommon.DefaultNodeServer
+	state          *nodeState
+	defaultMounter string
+	locks          *operationLocks
+	mounts         mount.Interface
+	// newMounter returns the mounter of a volume
+	newMounter func(meta *s3.FSMeta, cfg *s3.Config) (mounter.Mounter, error)
+	// newClient returns the object store of the S3 endpoint of a request
+	newClient func(cfg *s3.Config) (s3.ObjectStore, error)
 }
 
 func (ns *nodeServer) NodePublishVolume(ctx context.Context, req *csi.NodePublishVolumeRequest) (*csi.NodePublishVolumeResponse, error) {
 	volumeID := req.GetVolumeId()
 	targetPath := req.GetTargetPath()
 	stagingTargetPath := req.GetStagingTargetPath()
-	bucketName, prefix := volumeIDToBucketPrefix(volumeID)
+	ephemeral := isEphemeral(req.GetVolumeContext())
 
 	// Check arguments
 	if req.GetVolumeCapability() == nil {
@@ -50,14 +61,20 @@ func (ns *nodeServer) NodePublishVolume(ctx context.Context, req *csi.NodePublis
 	if len(volumeID) == 0 {
 		return nil, status.Error(codes.InvalidArgument, "Volume ID missing in request")
 	}
-	if len(stagingTargetPath) == 0 {
+	if len(stagingTargetPath) == 0 && !ephemeral {
 		return nil, status.Error(codes.InvalidArgument, "Staging Target path missing in request")
 	}
 	if len(targetPath) == 0 {
 		return nil, status.Error(codes.InvalidArgument, "Target path missing in request")
 	}
 
-	notMnt, err := checkMount(targetPath)
+	release, err := ns.locks.lockVolume(volumeID, targetPath)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+
+	notMnt, err := ns.checkMount(targetPath)
 	if err != nil {
 		return nil, status.Error(codes.Internal, err.Error())
 	}
@@ -65,38 +82,60 @@ func (ns *nodeServer) NodePublishVolume(ctx context.Context, req *csi.NodePublis
 		return &csi.NodePublishVolumeResponse{}, nil
 	}
 
+	if ephemeral {
+		if err := ns.publishEphemeral(req); err != nil {
+			return nil, statusError(codes.Internal, err)
+		}
+		return &csi.NodePublishVolumeResponse{}, nil
+	}
+
 	deviceID := ""
 	if req.GetPublishContext() != nil {
 		deviceID = req.GetPublishContext()[deviceID]
 	}
 
-	// TODO: Implement readOnly & mountFlags
+	// TODO: Implement mountFlags
 	readOnly := req.GetReadonly()
 	// TODO: check if attrib is correct with context.
 	attrib := req.GetVolumeContext()
 	mountFlags := req.GetVolumeCapability().GetMount().GetMountFlags()
 
-	glog.V(4).Infof("target %v\ndevice %v\nreadonly %v\nvolumeId %v\nattributes %v\nmountflags %v\n",
-		targetPath, deviceID, readOnly, volumeID, attrib, mountFlags)
+	logging.V(4).InfoS("publishing volume", "target", targetPath, "device", deviceID, "readonly", readOnly,
+		"volumeID", volumeID, "attributes", logging.MaskMap(attrib), "mountflags", mountFlags)
 
-	s3, err := s3.NewClientFromSecret(req.GetSecrets())
+	cfg, err := ns.s3Config(req.GetSecrets(), volumeProfile(volumeID, attrib))
 	if err != nil {
-		return nil, fmt.Errorf("failed to initialize S3 client: %s", err)
+		return nil, statusError(codes.Internal, err)
 	}
-	meta, err := s3.GetFSMeta(bucketName, prefix)
+	client, err := ns.newClient(cfg)
 	if err != nil {
-		return nil, err
+		return nil, status.Error(codes.Internal, fmt.Sprintf("failed to initialize S3 client: %s", err))
+	}
+	store, err := client.MetaStore(attrib[s3.MetaStoreKey], attrib)
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	meta, err := getFSMeta(store, volumeID, attrib)
+	if err != nil {
+		return nil, statusError(codes.Unavailable, err)
+	}
+	if meta.CapacityExceeded && meta.QuotaEnforcement == s3.QuotaReadOnly && !readOnly {
+		logging.WarningS("volume exceeds its capacity, publishing it read only", "volumeID", volumeID, "usedBytes", meta.UsedBytes, "capacityBytes", meta.CapacityBytes)
+		readOnly = true
 	}
 
-	mounter, err := mounter.New(meta, s3.Config)
+	m, err := ns.newMounter(meta, cfg)
 	if err != nil {
-		return nil, err
+		return nil, statusError(codes.Internal, err)
 	}
-	if err := mounter.Mount(stagingTargetPath, targetPath); err != nil {
-		return nil, err
+	if err := m.Mount(stagingTargetPath, targetPath, readOnly); err != nil {
+		return nil, statusError(codes.Internal, err)
+	}
+	if err := ns.state.addTarget(volumeID, targetPath); err != nil {
+		logging.ErrorS(err, "failed to record target of volume", "volumeID", volumeID, "target", targetPath)
 	}
 
-	glog.V(4).Infof("s3: volume %s successfuly mounted to %s", volumeID, targetPath)
+	logging.V(4).InfoS("volume mounted", "volumeID", volumeID, "target", targetPath)
 
 	return &csi.NodePublishVolumeResponse{}, nil
 }
@@ -113,10 +152,34 @@ func (ns *nodeServer) NodeUnpublishVolume(ctx context.Context, req *csi.NodeUnpu
 		return nil, status.Error(codes.InvalidArgument, "Target path missing in request")
 	}
 
-	if err := mounter.FuseUnmount(targetPath); err != nil {
+	release, err := ns.locks.lockVolume(volumeID, targetPath)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+
+	mounted, err := ns.isMountPoint(targetPath)
+	if err != nil {
 		return nil, status.Error(codes.Internal, err.Error())
 	}
-	glog.V(4).Infof("s3: volume %s has been unmounted.", volumeID)
+	if mounted {
+		if err := ns.mounts.Unmount(targetPath); err != nil {
+			return nil, status.Error(codes.Internal, err.Error())
+		}
+	}
+	if err := ns.state.removeTarget(volumeID, targetPath); err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	vs, err := ns.state.get(volumeID)
+	if err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	if vs != nil && vs.Ephemeral {
+		if err := ns.unpublishEphemeral(vs); err != nil {
+			return nil, status.Error(codes.Internal, err.Error())
+		}
+	}
+	logging.V(4).InfoS("volume unmounted", "volumeID", volumeID, "target", targetPath)
 
 	return &csi.NodeUnpublishVolumeResponse{}, nil
 }
@@ -124,7 +187,6 @@ func (ns *nodeServer) NodeUnpublishVolume(ctx context.Context, req *csi.NodeUnpu
 func (ns *nodeServer) NodeStageVolume(ctx context.Context, req *csi.NodeStageVolumeRequest) (*csi.NodeStageVolumeResponse, error) {
 	volumeID := req.GetVolumeId()
 	stagingTargetPath := req.GetStagingTargetPath()
-	bucketName, prefix := volumeIDToBucketPrefix(volumeID)
 
 	// Check arguments
 	if len(volumeID) == 0 {
@@ -139,27 +201,70 @@ func (ns *nodeServer) NodeStageVolume(ctx context.Context, req *csi.NodeStageVol
 		return nil, status.Error(codes.InvalidArgument, "NodeStageVolume Volume Capability must be provided")
 	}
 
-	notMnt, err := checkMount(stagingTargetPath)
+	release, err := ns.locks.lockVolume(volumeID, stagingTargetPath)
 	if err != nil {
+		return nil, err
+	}
+	defer release()
+
+	notMnt, err := ns.checkMount(stagingTargetPath)
+	corrupted := mount.IsCorruptedMnt(err)
+	if err != nil && !corrupted {
 		return nil, status.Error(codes.Internal, err.Error())
 	}
-	if !notMnt {
+	if err == nil && !notMnt {
 		return &csi.NodeStageVolumeResponse{}, nil
 	}
-	client, err := s3.NewClientFromSecret(req.GetSecrets())
+	cfg, err := ns.s3Config(req.GetSecrets(), volumeProfile(volumeID, req.GetVolumeContext()))
 	if err != nil {
-		return nil, fmt.Errorf("failed to initialize S3 client: %s", err)
+		return nil, statusError(codes.Internal, err)
 	}
-	meta, err := client.GetFSMeta(bucketName, prefix)
+	client, err := ns.newClient(cfg)
 	if err != nil {
-		return nil, err
+		return nil, status.Error(codes.Internal, fmt.Sprintf("failed to initialize S3 client: %s", err))
 	}
-	mounter, err := mounter.New(meta, client.Config)
+	store, err := client.MetaStore(req.GetVolumeContext()[s3.MetaStoreKey], req.GetVolumeContext())
 	if err != nil {
-		return nil, err
+		return nil, status.Error(codes.InvalidArgument, err.Error())
 	}
-	if err := mounter.Stage(stagingTargetPath); err != nil {
-		return nil, err
+	meta, err := getFSMeta(store, volumeID, req.GetVolumeContext())
+	if err != nil {
+		return nil, statusError(codes.Unavailable, err)
+	}
+	mounter.SetMountGroup(meta, req.GetVolumeCapability().GetMount().GetVolumeMountGroup())
+	mounterType := mounter.Type(meta, cfg)
+	// static volumes choose their mounter in the volume context and
+	// bypass the check of CreateVolume
+	if !config.Get().IsMounterAllowed(mounterType) {
+		return nil, status.Error(codes.InvalidArgument, fmt.Sprintf("Mounter %s is not allowed", mounterType))
+	}
+	// record the mounter in use so unstaging does not depend on the default
+	meta.Mounter = mounterType
+	m, err := ns.newMounter(meta, cfg)
+	if err != nil {
+		return nil, statusError(codes.Internal, err)
+	}
+	if corrupted {
+		// the FUSE process of the staged volume died, tear down
+		// what is left of the mount and stage it again
+		logging.WarningS("staged mount of volume is broken, restarting it", "volumeID", volumeID, "stagingTarget", stagingTargetPath)
+		if err := m.Unstage(stagingTargetPath); err != nil {
+			return nil, status.Error(codes.Internal, err.Error())
+		}
+		metrics.FuseRestarts.WithLabelValues(mounterType).Inc()
+	}
+	if err := m.Stage(stagingTargetPath); err != nil {
+		return nil, statusError(codes.Internal, err)
+	}
+	if err := ns.state.save(&volumeState{
+		VolumeID:          volumeID,
+		StagingTargetPath: stagingTargetPath,
+		Meta:              meta,
+	}); err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	if !corrupted {
+		metrics.ActiveMounts.WithLabelValues(mounterType).Inc()
 	}
 
 	return &csi.NodeStageVolumeResponse{}, nil
@@ -177,24 +282,79 @@ func (ns *nodeServer) NodeUnstageVolume(ctx context.Context, req *csi.NodeUnstag
 		return nil, status.Error(codes.InvalidArgument, "Target path missing in request")
 	}
 
+	release, err := ns.locks.lockVolume(volumeID, stagingTargetPath)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+
+	// unstage requests do not contain secrets, so we rely on the state
+	// persisted during NodeStageVolume to find the mounter of the volume
+	vs, err := ns.state.get(volumeID)
+	if err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	meta := &s3.FSMeta{}
+	if vs != nil {
+		meta = vs.Meta
+		for _, targetPath := range vs.TargetPaths {
+			mounted, err := ns.isMountPoint(targetPath)
+			if err != nil {
+				return nil, status.Error(codes.Internal, err.Error())
+			}
+			if mounted {
+				return nil, status.Error(codes.FailedPrecondition, fmt.Sprintf("volume %s is still published to %s", volumeID, targetPath))
+			}
+		}
+	} else {
+		logging.WarningS("no state found for volume, falling back to default mounter", "volumeID", volumeID)
+	}
+
+	mounted, err := ns.isMountPoint(stagingTargetPath)
+	if err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	if mounted {
+		m, err := ns.newMounter(meta, &s3.Config{Mounter: defaultMounter(ns.defaultMounter)})
+		if err != nil {
+			return nil, status.Error(codes.Internal, err.Error())
+		}
+		if err := m.Unstage(stagingTargetPath); err != nil {
+			return nil, status.Error(codes.Internal, err.Error())
+		}
+	}
+	if err := os.Remove(stagingTargetPath); err != nil && !os.IsNotExist(err) {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	if err := ns.state.remove(volumeID); err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	if vs != nil {
+		metrics.ActiveMounts.WithLabelValues(mounter.Type(meta, &s3.Config{Mounter: defaultMounter(ns.defaultMounter)})).Dec()
+	}
+	logging.V(4).InfoS("volume unstaged", "volumeID", volumeID)
+
 	return &csi.NodeUnstageVolumeResponse{}, nil
 }
 
 // NodeGetCapabilities returns the supported capabilities of the node server
 func (ns *nodeServer) NodeGetCapabilities(ctx context.Context, req *csi.NodeGetCapabilitiesRequest) (*csi.NodeGetCapabilitiesResponse, error) {
-	// currently there is a single NodeServer capability according to the spec
-	nscap := &csi.NodeServiceCapability{
-		Type: &csi.NodeServiceCapability_Rpc{
-			Rpc: &csi.NodeServiceCapability_RPC{
-				Type: csi.NodeServiceCapability_RPC_STAGE_UNSTAGE_VOLUME,
+	capabilities := []*csi.NodeServiceCapability{}
+	for _, c := range []csi.NodeServiceCapability_RPC_Type{
+		csi.NodeServiceCapability_RPC_STAGE_UNSTAGE_VOLUME,
+		csi.NodeServiceCapability_RPC_VOLUME_MOUNT_GROUP,
+	} {
+		capabilities = append(capabilities, &csi.NodeServiceCapability{
+			Type: &csi.NodeServiceCapability_Rpc{
+				Rpc: &csi.NodeServiceCapability_RPC{
+					Type: c,
+				},
 			},
-		},
+		})
 	}
 
 	return &csi.NodeGetCapabilitiesResponse{
-		Capabilities: []*csi.NodeServiceCapability{
-			nscap,
-		},
+		Capabilities: capabilities,
 	}, nil
 }
 
@@ -202,8 +362,44 @@ func (ns *nodeServer) NodeExpandVolume(ctx context.Context, req *csi.NodeExpandV
 	return &csi.NodeExpandVolumeResponse{}, status.Error(codes.Unimplemented, "NodeExpandVolume is not implemented")
 }
 
-func checkMount(targetPath string) (bool, error) {
-	notMnt, err := mount.New("").IsLikelyNotMountPoint(targetPath)
+// statusError returns err with code unless it already has a status. Errors
+// of the S3 backend are Unavailable and those of mounters Internal, so
+// the CO retries them.
+func statusError(code codes.Code, err error) error {
+	if _, ok := status.FromError(err); ok {
+		return err
+	}
+	return status.Error(code, err.Error())
+}
+
+// isMountPoint returns true if path exists and is likely a mount point
+func (ns *nodeServer) isMountPoint(path string) (bool, error) {
+	notMnt, err := ns.mounts.IsLikelyNotMountPoint(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return false, nil
+		}
+		return false, err
+	}
+	return !notMnt, nil
+}
+
+// s3Config returns the configuration of the S3 endpoint of a volume,
+// volumes fall back to the default mounter of the node unless their
+// profile has one
+func (ns *nodeServer) s3Config(secrets map[string]string, profile string) (*s3.Config, error) {
+	cfg, err := s3Config(secrets, profile)
+	if err != nil {
+		return nil, err
+	}
+	if cfg.Mounter == "" {
+		cfg.Mounter = defaultMounter(ns.defaultMounter)
+	}
+	return cfg, nil
+}
+
+func (ns *nodeServer) checkMount(targetPath string) (bool, error) {
+	notMnt, err := ns.mounts.IsLikelyNotMountPoint(targetPath)
 	if err != nil {
 		if os.IsNotExist(err) {
 			if err = os.MkdirAll(targetPath, 0750); err != nil {
@@ -216,3 +412,73 @@ func checkMount(targetPath string) (bool, error) {
 	}
 	return notMnt, nil
 }
+
+// initActiveMounts initializes the active mounts metric
+// with the volumes already staged on this node
+func (ns *nodeServer) initActiveMounts() {
+	states, err := ns.state.list()
+	if err != nil {
+		logging.ErrorS(err, "failed to list staged volumes")
+		return
+	}
+	for _, vs := range states {
+		metrics.ActiveMounts.WithLabelValues(mounter.Type(vs.Meta, &s3.Config{Mounter: defaultMounter(ns.defaultMounter)})).Inc()
+	}
+}
+
+// runStateGC periodically removes the state of volumes whose staging
+// path has been removed without the volume being unstaged
+func (ns *nodeServer) runStateGC(stop <-chan struct{}) {
+	for {
+		interval := config.Get().StateGCInterval.Duration
+		enabled := interval > 0
+		if !enabled {
+			// check again later in case the configuration changes
+			interval = time.Minute
+		}
+		select {
+		case <-stop:
+			return
+		case <-time.After(interval):
+		}
+		if enabled {
+			ns.gcState()
+		}
+	}
+}
+
+func (ns *nodeServer) gcState() {
+	states, err := ns.state.list()
+	if err != nil {
+		logging.ErrorS(err, "failed to list staged volumes")
+		return
+	}
+	for _, vs := range states {
+		if _, err := os.Stat(vs.StagingTargetPath); !os.IsNotExist(err) {
+			continue
+		}
+		logging.InfoS("staging path of volume is gone, removing its state", "volumeID", vs.VolumeID, "stagingTarget", vs.StagingTargetPath)
+		if err := ns.state.remove(vs.VolumeID); err != nil {
+			logging.ErrorS(err, "failed to remove state of volume", "volumeID", vs.VolumeID)
+			continue
+		}
+		metrics.ActiveMounts.WithLabelValues(mounter.Type(vs.Meta, &s3.Config{Mounter: defaultMounter(ns.defaultMounter)})).Dec()
+	}
+}
+
+// reportMounts logs which staged volumes keep working after the driver exits
+func (ns *nodeServer) reportMounts() {
+	states, err := ns.state.list()
+	if err != nil {
+		logging.ErrorS(err, "failed to list staged volumes")
+		return
+	}
+	for _, vs := range states {
+		mounterType := mounter.Type(vs.Meta, &s3.Config{Mounter: defaultMounter(ns.defaultMounter)})
+		if mounter.RunsInProcess(mounterType) {
+			logging.WarningS("volume is served within the driver process and stops working when it exits", "volumeID", vs.VolumeID, "stagingTarget", vs.StagingTargetPath, "mounter", mounterType)
+		} else {
+			logging.InfoS("volume is served by an external process and stays mounted", "volumeID", vs.VolumeID, "stagingTarget", vs.StagingTargetPath, "mounter", mounterType)
+		}
+	}
+}
@@ -0,0 +1,492 @@
+package driver
+
+import (
+	"errors"
+	"path/filepath"
+	"reflect"
+	"syscall"
+	"testing"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/ctrox/csi-s3/pkg/config"
+	"github.com/ctrox/csi-s3/pkg/mounter"
+	"github.com/ctrox/csi-s3/pkg/s3"
+	csicommon "github.com/kubernetes-csi/drivers/pkg/csi-common"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"k8s.io/mount-utils"
+)
+
+type nodeTestEnv struct {
+	ns      *nodeServer
+	store   *s3.FakeObjectStore
+	mounts  *mount.FakeMounter
+	mounter *mounter.FakeMounter
+	staging string
+	target  string
+}
+
+func newNodeTestEnv(t *testing.T) *nodeTestEnv {
+	dir := t.TempDir()
+	state, err := newNodeState(filepath.Join(dir, "state"))
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	env := &nodeTestEnv{
+		store:   s3.NewFakeObjectStore(),
+		mounts:  mount.NewFakeMounter(nil),
+		staging: filepath.Join(dir, "staging"),
+		target:  filepath.Join(dir, "pod", "mount"),
+	}
+	env.mounter = mounter.NewFakeMounter(env.mounts)
+	d := csicommon.NewCSIDriver(driverName, vendorVersion, "test-node")
+	env.ns = &nodeServer{
+		DefaultNodeServer: csicommon.NewDefaultNodeServer(d),
+		state:             state,
+		locks:             newOperationLocks(),
+		mounts:            env.mounts,
+		newMounter:        env.mounter.New,
+		newClient: func(cfg *s3.Config) (s3.ObjectStore, error) {
+			return env.store, nil
+		},
+	}
+	if err := env.store.CreateBucket("bucket"); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if err := env.store.SetFSMeta(&s3.FSMeta{BucketName: "bucket", Mounter: "rclone", FSPath: "csi-fs"}); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	return env
+}
+
+func (env *nodeTestEnv) actions() []string {
+	actions := []string{}
+	for _, a := range env.mounter.GetLog() {
+		actions = append(actions, a.Action)
+	}
+	return actions
+}
+
+func (env *nodeTestEnv) stageRequest() *csi.NodeStageVolumeRequest {
+	return &csi.NodeStageVolumeRequest{
+		VolumeId:          "bucket",
+		StagingTargetPath: env.staging,
+		VolumeCapability:  mountCapability(),
+	}
+}
+
+func (env *nodeTestEnv) publishRequest() *csi.NodePublishVolumeRequest {
+	return &csi.NodePublishVolumeRequest{
+		VolumeId:          "bucket",
+		StagingTargetPath: env.staging,
+		TargetPath:        env.target,
+		VolumeCapability:  mountCapability(),
+	}
+}
+
+func (env *nodeTestEnv) stage(t *testing.T) {
+	if _, err := env.ns.NodeStageVolume(context.Background(), env.stageRequest()); err != nil {
+		t.Fatalf("unexpected error staging volume: %s", err)
+	}
+}
+
+func (env *nodeTestEnv) publish(t *testing.T) {
+	if _, err := env.ns.NodePublishVolume(context.Background(), env.publishRequest()); err != nil {
+		t.Fatalf("unexpected error publishing volume: %s", err)
+	}
+}
+
+// setMeta modifies the metadata of the volume
+func (env *nodeTestEnv) setMeta(t *testing.T, modify func(meta *s3.FSMeta)) {
+	meta, err := env.store.GetFSMeta("bucket", "")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	modify(meta)
+	if err := env.store.SetFSMeta(meta); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+}
+
+func mountCapability() *csi.VolumeCapability {
+	return &csi.VolumeCapability{
+		AccessType: &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{}},
+		AccessMode: &csi.VolumeCapability_AccessMode{Mode: csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER},
+	}
+}
+
+func TestNodeStageVolume(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		setup   func(env *nodeTestEnv)
+		modify  func(req *csi.NodeStageVolumeRequest)
+		code    codes.Code
+		actions []string
+	}{
+		{
+			name:    "stages volume",
+			actions: []string{"stage"},
+		},
+		{
+			name:   "missing volume ID",
+			modify: func(req *csi.NodeStageVolumeRequest) { req.VolumeId = "" },
+			code:   codes.InvalidArgument,
+		},
+		{
+			name:   "missing staging path",
+			modify: func(req *csi.NodeStageVolumeRequest) { req.StagingTargetPath = "" },
+			code:   codes.InvalidArgument,
+		},
+		{
+			name:   "missing capability",
+			modify: func(req *csi.NodeStageVolumeRequest) { req.VolumeCapability = nil },
+			code:   codes.InvalidArgument,
+		},
+		{
+			name: "unknown metadata store",
+			modify: func(req *csi.NodeStageVolumeRequest) {
+				req.VolumeContext = map[string]string{"metadataStore": "configmap"}
+			},
+			code: codes.InvalidArgument,
+		},
+		{
+			name: "volume without metadata uses volume context",
+			modify: func(req *csi.NodeStageVolumeRequest) {
+				req.VolumeId = "other/data"
+				req.VolumeContext = map[string]string{"mounter": "s3fs"}
+			},
+			actions: []string{"stage"},
+		},
+		{
+			name: "invalid volume context of volume without metadata",
+			modify: func(req *csi.NodeStageVolumeRequest) {
+				req.VolumeId = "other"
+				req.VolumeContext = map[string]string{"uid": "nobody"}
+			},
+			code: codes.InvalidArgument,
+		},
+		{
+			name:  "metadata error",
+			setup: func(env *nodeTestEnv) { env.store.SetError("GetFSMeta", errors.New("access denied")) },
+			code:  codes.Unavailable,
+		},
+		{
+			name:  "stage error",
+			setup: func(env *nodeTestEnv) { env.mounter.SetError("stage", errors.New("rclone failed")) },
+			code:  codes.Internal,
+		},
+		{
+			name: "already staged",
+			setup: func(env *nodeTestEnv) {
+				env.stage(t)
+				env.mounter.ResetLog()
+			},
+			actions: []string{},
+		},
+		{
+			name: "restages broken mount",
+			setup: func(env *nodeTestEnv) {
+				env.stage(t)
+				env.mounter.ResetLog()
+				env.mounts.MountCheckErrors = map[string]error{env.staging: syscall.ENOTCONN}
+			},
+			actions: []string{"unstage", "stage"},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			env := newNodeTestEnv(t)
+			if tc.setup != nil {
+				tc.setup(env)
+			}
+			req := env.stageRequest()
+			if tc.modify != nil {
+				tc.modify(req)
+			}
+			_, err := env.ns.NodeStageVolume(context.Background(), req)
+			if status.Code(err) != tc.code {
+				t.Fatalf("expected code %s, got %v", tc.code, err)
+			}
+			if tc.actions != nil && !reflect.DeepEqual(env.actions(), tc.actions) {
+				t.Errorf("expected actions %v, got %v", tc.actions, env.actions())
+			}
+			if err != nil {
+				return
+			}
+			vs, err := env.ns.state.get(req.VolumeId)
+			if err != nil || vs == nil {
+				t.Fatalf("expected state of staged volume, got %v, %v", vs, err)
+			}
+			if vs.Meta.Mounter == "" || vs.StagingTargetPath != env.staging {
+				t.Errorf("unexpected state of staged volume: %+v", vs)
+			}
+		})
+	}
+}
+
+func TestNodeStageVolumeAllowedMounters(t *testing.T) {
+	cfg := config.Default()
+	cfg.AllowedMounters = []string{"rclone"}
+	defer config.Set(config.Get())
+	config.Set(cfg)
+
+	env := newNodeTestEnv(t)
+	env.stage(t)
+
+	req := env.stageRequest()
+	req.VolumeId = "other/data"
+	req.StagingTargetPath = env.staging + "-other"
+	req.VolumeContext = map[string]string{"mounter": "s3fs"}
+	_, err := env.ns.NodeStageVolume(context.Background(), req)
+	if status.Code(err) != codes.InvalidArgument {
+		t.Fatalf("expected code %s, got %v", codes.InvalidArgument, err)
+	}
+	if expected := []string{"stage"}; !reflect.DeepEqual(env.actions(), expected) {
+		t.Errorf("expected actions %v, got %v", expected, env.actions())
+	}
+	if vs, err := env.ns.state.get(req.VolumeId); err != nil || vs != nil {
+		t.Errorf("expected no state of rejected volume, got %v, %v", vs, err)
+	}
+}
+
+func TestNodePublishVolume(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		setup    func(env *nodeTestEnv)
+		modify   func(req *csi.NodePublishVolumeRequest)
+		code     codes.Code
+		actions  []string
+		readOnly bool
+	}{
+		{
+			name:    "publishes volume",
+			setup:   func(env *nodeTestEnv) { env.stage(t) },
+			actions: []string{"mount"},
+		},
+		{
+			name:  "publishes volume read only",
+			setup: func(env *nodeTestEnv) { env.stage(t) },
+			modify: func(req *csi.NodePublishVolumeRequest) {
+				req.Readonly = true
+			},
+			actions:  []string{"mount"},
+			readOnly: true,
+		},
+		{
+			name: "publishes volume exceeding its capacity read only",
+			setup: func(env *nodeTestEnv) {
+				env.setMeta(t, func(meta *s3.FSMeta) {
+					meta.QuotaEnforcement, meta.CapacityExceeded = s3.QuotaReadOnly, true
+				})
+				env.stage(t)
+			},
+			actions:  []string{"mount"},
+			readOnly: true,
+		},
+		{
+			name: "publishes volume exceeding its capacity without enforcement",
+			setup: func(env *nodeTestEnv) {
+				env.setMeta(t, func(meta *s3.FSMeta) { meta.CapacityExceeded = true })
+				env.stage(t)
+			},
+			actions: []string{"mount"},
+		},
+		{
+			name:   "missing volume ID",
+			modify: func(req *csi.NodePublishVolumeRequest) { req.VolumeId = "" },
+			code:   codes.InvalidArgument,
+		},
+		{
+			name:   "missing staging path",
+			modify: func(req *csi.NodePublishVolumeRequest) { req.StagingTargetPath = "" },
+			code:   codes.InvalidArgument,
+		},
+		{
+			name:   "missing target path",
+			modify: func(req *csi.NodePublishVolumeRequest) { req.TargetPath = "" },
+			code:   codes.InvalidArgument,
+		},
+		{
+			name:   "missing capability",
+			modify: func(req *csi.NodePublishVolumeRequest) { req.VolumeCapability = nil },
+			code:   codes.InvalidArgument,
+		},
+		{
+			name:    "volume not staged",
+			code:    codes.Internal,
+			actions: []string{"mount"},
+		},
+		{
+			name: "already published",
+			setup: func(env *nodeTestEnv) {
+				env.stage(t)
+				env.publish(t)
+				env.mounter.ResetLog()
+			},
+			actions: []string{},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			env := newNodeTestEnv(t)
+			if tc.setup != nil {
+				tc.setup(env)
+				env.mounter.ResetLog()
+			}
+			req := env.publishRequest()
+			if tc.modify != nil {
+				tc.modify(req)
+			}
+			_, err := env.ns.NodePublishVolume(context.Background(), req)
+			if status.Code(err) != tc.code {
+				t.Fatalf("expected code %s, got %v", tc.code, err)
+			}
+			if tc.actions != nil && !reflect.DeepEqual(env.actions(), tc.actions) {
+				t.Errorf("expected actions %v, got %v", tc.actions, env.actions())
+			}
+			if err != nil || len(tc.actions) == 0 {
+				return
+			}
+			if log := env.mounter.GetLog(); log[0].ReadOnly != tc.readOnly {
+				t.Errorf("expected read only %v, got %v", tc.readOnly, log[0].ReadOnly)
+			}
+			mps, _ := env.mounts.List()
+			mp := mps[len(mps)-1]
+			ro := false
+			for _, opt := range mp.Opts {
+				ro = ro || opt == "ro"
+			}
+			if mp.Path != env.target || ro != tc.readOnly {
+				t.Errorf("unexpected mount point %+v", mp)
+			}
+			vs, _ := env.ns.state.get("bucket")
+			if vs == nil || len(vs.TargetPaths) != 1 || vs.TargetPaths[0] != env.target {
+				t.Errorf("expected target to be recorded, got %+v", vs)
+			}
+		})
+	}
+}
+
+func TestNodeUnpublishVolume(t *testing.T) {
+	env := newNodeTestEnv(t)
+	env.stage(t)
+	env.publish(t)
+
+	req := &csi.NodeUnpublishVolumeRequest{VolumeId: "bucket", TargetPath: env.target}
+	for i := 0; i < 2; i++ {
+		// unpublishing again succeeds
+		if _, err := env.ns.NodeUnpublishVolume(context.Background(), req); err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+	}
+	if mounted, _ := env.ns.isMountPoint(env.target); mounted {
+		t.Error("expected target to be unmounted")
+	}
+	if vs, _ := env.ns.state.get("bucket"); vs == nil || len(vs.TargetPaths) != 0 {
+		t.Errorf("expected target to be removed from state, got %+v", vs)
+	}
+
+	for _, req := range []*csi.NodeUnpublishVolumeRequest{
+		{TargetPath: env.target},
+		{VolumeId: "bucket"},
+	} {
+		if _, err := env.ns.NodeUnpublishVolume(context.Background(), req); status.Code(err) != codes.InvalidArgument {
+			t.Errorf("expected InvalidArgument for %v, got %v", req, err)
+		}
+	}
+}
+
+func TestNodeUnstageVolume(t *testing.T) {
+	env := newNodeTestEnv(t)
+	env.stage(t)
+	env.publish(t)
+	env.mounter.ResetLog()
+
+	req := &csi.NodeUnstageVolumeRequest{VolumeId: "bucket", StagingTargetPath: env.staging}
+	if _, err := env.ns.NodeUnstageVolume(context.Background(), req); status.Code(err) != codes.FailedPrecondition {
+		t.Fatalf("expected FailedPrecondition while the volume is published, got %v", err)
+	}
+	if _, err := env.ns.NodeUnpublishVolume(context.Background(), &csi.NodeUnpublishVolumeRequest{VolumeId: "bucket", TargetPath: env.target}); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	for i := 0; i < 2; i++ {
+		// unstaging again succeeds
+		if _, err := env.ns.NodeUnstageVolume(context.Background(), req); err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+	}
+	if actions := env.actions(); !reflect.DeepEqual(actions, []string{"unstage"}) {
+		t.Errorf("expected volume to be unstaged once, got %v", actions)
+	}
+	if vs, _ := env.ns.state.get("bucket"); vs != nil {
+		t.Errorf("expected state to be removed, got %+v", vs)
+	}
+
+	env.stage(t)
+	env.mounter.SetError("unstage", errors.New("busy"))
+	if _, err := env.ns.NodeUnstageVolume(context.Background(), req); status.Code(err) != codes.Internal {
+		t.Errorf("expected Internal, got %v", err)
+	}
+}
+
+func TestNodePublishEphemeralVolume(t *testing.T) {
+	env := newNodeTestEnv(t)
+	req := &csi.NodePublishVolumeRequest{
+		VolumeId:         "csi-1234",
+		TargetPath:       env.target,
+		VolumeCapability: mountCapability(),
+		Readonly:         true,
+		VolumeContext: map[string]string{
+			"csi.storage.k8s.io/ephemeral": "true",
+			"bucket":                       "data",
+			"mounter":                      "rclone",
+		},
+	}
+	if _, err := env.ns.NodePublishVolume(context.Background(), req); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	log := env.mounter.GetLog()
+	if !reflect.DeepEqual(env.actions(), []string{"stage", "mount"}) || log[0].Meta.BucketName != "data" || !log[1].ReadOnly {
+		t.Errorf("unexpected actions %+v", log)
+	}
+	if mounted, _ := env.ns.isMountPoint(ephemeralStagingPath(env.target)); !mounted {
+		t.Error("expected ephemeral volume to be staged")
+	}
+
+	env.mounter.ResetLog()
+	if _, err := env.ns.NodeUnpublishVolume(context.Background(), &csi.NodeUnpublishVolumeRequest{VolumeId: "csi-1234", TargetPath: env.target}); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if !reflect.DeepEqual(env.actions(), []string{"unstage"}) {
+		t.Errorf("expected ephemeral volume to be unstaged, got %v", env.actions())
+	}
+	if vs, _ := env.ns.state.get("csi-1234"); vs != nil {
+		t.Errorf("expected state to be removed, got %+v", vs)
+	}
+
+	// a failed publish leaves nothing behind
+	env.mounter.ResetLog()
+	env.mounter.SetError("mount", errors.New("busy"))
+	if _, err := env.ns.NodePublishVolume(context.Background(), req); status.Code(err) != codes.Internal {
+		t.Errorf("expected Internal, got %v", err)
+	}
+	if !reflect.DeepEqual(env.actions(), []string{"stage", "unstage"}) {
+		t.Errorf("expected ephemeral volume to be unstaged, got %v", env.actions())
+	}
+	if vs, _ := env.ns.state.get("csi-1234"); vs != nil {
+		t.Errorf("expected state to be removed, got %+v", vs)
+	}
+	if mounted, _ := env.ns.isMountPoint(ephemeralStagingPath(env.target)); mounted {
+		t.Error("expected staging mount to be removed")
+	}
+	env.mounter.SetError("mount", nil)
+
+	for _, volumeContext := range []map[string]string{
+		{"csi.storage.k8s.io/ephemeral": "true"},
+		{"csi.storage.k8s.io/ephemeral": "true", "bucket": "data", "mounter": "s3backer"},
+	} {
+		req.VolumeContext = volumeContext
+		if _, err := env.ns.NodePublishVolume(context.Background(), req); status.Code(err) != codes.InvalidArgument {
+			t.Errorf("expected InvalidArgument for %v, got %v", volumeContext, err)
+		}
+	}
+}
@@ -0,0 +1,188 @@
+package driver
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/ctrox/csi-s3/pkg/s3"
+)
+
+// volumeState is persisted on the node for every staged volume so it can
+// be torn down without access to the secrets or the bucket.
+type volumeState struct {
+	VolumeID          string     `json:"VolumeID"`
+	StagingTargetPath string     `json:"StagingTargetPath"`
+	Meta              *s3.FSMeta `json:"Meta"`
+	TargetPaths       []string   `json:"TargetPaths"`
+	// Ephemeral volumes are staged by the driver itself on publish
+	Ephemeral bool `json:"Ephemeral,omitempty"`
+}
+
+// nodeState stores a volumeState per volume as a json file in dir
+type nodeState struct {
+	dir string
+	mu  sync.Mutex
+}
+
+func newNodeState(dir string) (*nodeState, error) {
+	if err := os.MkdirAll(dir, 0750); err != nil {
+		return nil, err
+	}
+	return &nodeState{dir: dir}, nil
+}
+
+func (n *nodeState) fileName(volumeID string) string {
+	// volume IDs can contain slashes
+	return path.Join(n.dir, url.PathEscape(volumeID)+".json")
+}
+
+// get returns the state of the volume or nil if it has no state on this node
+func (n *nodeState) get(volumeID string) (*volumeState, error) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return n.read(volumeID)
+}
+
+func (n *nodeState) read(volumeID string) (*volumeState, error) {
+	b, err := ioutil.ReadFile(n.fileName(volumeID))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	vs := &volumeState{}
+	if err := json.Unmarshal(b, vs); err != nil {
+		return nil, err
+	}
+	return vs, nil
+}
+
+func (n *nodeState) write(vs *volumeState) error {
+	b, err := json.Marshal(vs)
+	if err != nil {
+		return err
+	}
+	// write to a temporary file first so we never leave a partial state behind
+	tmp := n.fileName(vs.VolumeID) + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(b); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp, n.fileName(vs.VolumeID))
+}
+
+// flush ensures all state changes made so far are persisted to disk
+func (n *nodeState) flush() error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	dir, err := os.Open(n.dir)
+	if err != nil {
+		return err
+	}
+	defer dir.Close()
+	return dir.Sync()
+}
+
+// save persists the state of a staged volume, keeping known target paths
+func (n *nodeState) save(vs *volumeState) error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	existing, err := n.read(vs.VolumeID)
+	if err != nil {
+		return err
+	}
+	if existing != nil && vs.TargetPaths == nil {
+		vs.TargetPaths = existing.TargetPaths
+	}
+	return n.write(vs)
+}
+
+// addTarget records targetPath as published for the volume
+func (n *nodeState) addTarget(volumeID, targetPath string) error {
+	return n.update(volumeID, func(vs *volumeState) {
+		for _, t := range vs.TargetPaths {
+			if t == targetPath {
+				return
+			}
+		}
+		vs.TargetPaths = append(vs.TargetPaths, targetPath)
+	})
+}
+
+// removeTarget removes targetPath from the published targets of the volume
+func (n *nodeState) removeTarget(volumeID, targetPath string) error {
+	return n.update(volumeID, func(vs *volumeState) {
+		targets := []string{}
+		for _, t := range vs.TargetPaths {
+			if t != targetPath {
+				targets = append(targets, t)
+			}
+		}
+		vs.TargetPaths = targets
+	})
+}
+
+// update applies fn to the state of the volume if it has any
+func (n *nodeState) update(volumeID string, fn func(vs *volumeState)) error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	vs, err := n.read(volumeID)
+	if err != nil || vs == nil {
+		return err
+	}
+	fn(vs)
+	return n.write(vs)
+}
+
+// list returns the state of all volumes staged on this node
+func (n *nodeState) list() ([]*volumeState, error) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	files, err := filepath.Glob(path.Join(n.dir, "*.json"))
+	if err != nil {
+		return nil, err
+	}
+	states := []*volumeState{}
+	for _, file := range files {
+		volumeID, err := url.PathUnescape(strings.TrimSuffix(filepath.Base(file), ".json"))
+		if err != nil {
+			return nil, err
+		}
+		vs, err := n.read(volumeID)
+		if err != nil {
+			return nil, err
+		}
+		if vs != nil {
+			states = append(states, vs)
+		}
+	}
+	return states, nil
+}
+
+// remove deletes the state of the volume
+func (n *nodeState) remove(volumeID string) error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if err := os.Remove(n.fileName(volumeID)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
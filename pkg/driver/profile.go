@@ -0,0 +1,28 @@
+package driver
+
+import (
+	"errors"
+
+	"github.com/ctrox/csi-s3/pkg/s3"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// volumeProfile returns the endpoint profile of a volume. Statically
+// provisioned volumes may set it in their volume context instead of their ID.
+func volumeProfile(volumeID string, volumeContext map[string]string) string {
+	if h, err := parseVolumeID(volumeID); err == nil && h.profile != "" {
+		return h.profile
+	}
+	return volumeContext[s3.ProfileKey]
+}
+
+// s3Config returns the configuration of the S3 endpoint of profile
+// with the credentials of secrets
+func s3Config(secrets map[string]string, profile string) (*s3.Config, error) {
+	cfg, err := s3.ConfigForProfile(secrets, profile)
+	if errors.Is(err, s3.ErrUnknownProfile) {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	return cfg, err
+}
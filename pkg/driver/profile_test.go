@@ -0,0 +1,17 @@
+package driver
+
+import "testing"
+
+func TestVolumeProfile(t *testing.T) {
+	for volumeID, want := range map[string]string{
+		"v1/minio/pvc-1": "minio",
+		"minio:pvc-1":    "aws",
+		"v1//pvc-1":      "aws",
+		"pvc-1":          "aws",
+		"v2/minio/pvc-1": "aws",
+	} {
+		if p := volumeProfile(volumeID, map[string]string{"profile": "aws"}); p != want {
+			t.Errorf("volumeProfile(%q) = %q, want %q", volumeID, p, want)
+		}
+	}
+}
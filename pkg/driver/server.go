@@ -0,0 +1,152 @@
+package driver
+
+import (
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/ctrox/csi-s3/pkg/logging"
+	"github.com/kubernetes-csi/csi-lib-utils/protosanitizer"
+	csicommon "github.com/kubernetes-csi/drivers/pkg/csi-common"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+)
+
+// nonBlockingGRPCServer is a csicommon.NonBlockingGRPCServer which
+// allows to chain additional unary interceptors like metrics and
+// keeps track of in-flight calls for a graceful shutdown
+type nonBlockingGRPCServer struct {
+	wg           sync.WaitGroup
+	server       *grpc.Server
+	interceptors []grpc.UnaryServerInterceptor
+
+	mu       sync.Mutex
+	inFlight map[string]int
+}
+
+var _ csicommon.NonBlockingGRPCServer = &nonBlockingGRPCServer{}
+
+func newNonBlockingGRPCServer(interceptors ...grpc.UnaryServerInterceptor) *nonBlockingGRPCServer {
+	return &nonBlockingGRPCServer{
+		interceptors: interceptors,
+		inFlight:     map[string]int{},
+	}
+}
+
+func (s *nonBlockingGRPCServer) Start(endpoint string, ids csi.IdentityServer, cs csi.ControllerServer, ns csi.NodeServer) {
+	proto, addr, err := csicommon.ParseEndpoint(endpoint)
+	if err != nil {
+		logging.FatalS(err, "invalid endpoint", "endpoint", endpoint)
+	}
+
+	if proto == "unix" {
+		addr = "/" + addr
+		if err := os.Remove(addr); err != nil && !os.IsNotExist(err) {
+			logging.FatalS(err, "failed to remove socket", "path", addr)
+		}
+	}
+
+	listener, err := net.Listen(proto, addr)
+	if err != nil {
+		logging.FatalS(err, "failed to listen", "address", addr)
+	}
+
+	interceptors := append([]grpc.UnaryServerInterceptor{s.trackInFlight, logGRPC}, s.interceptors...)
+	s.server = grpc.NewServer(grpc.ChainUnaryInterceptor(interceptors...))
+
+	if ids != nil {
+		csi.RegisterIdentityServer(s.server, ids)
+	}
+	if cs != nil {
+		csi.RegisterControllerServer(s.server, cs)
+	}
+	if ns != nil {
+		csi.RegisterNodeServer(s.server, ns)
+	}
+
+	logging.InfoS("listening for connections", "address", listener.Addr().String())
+
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		if err := s.server.Serve(listener); err != nil {
+			logging.ErrorS(err, "failed to serve")
+		}
+	}()
+}
+
+func (s *nonBlockingGRPCServer) Wait() {
+	s.wg.Wait()
+}
+
+func (s *nonBlockingGRPCServer) Stop() {
+	s.server.GracefulStop()
+}
+
+func (s *nonBlockingGRPCServer) ForceStop() {
+	s.server.Stop()
+}
+
+// Shutdown stops accepting new calls and waits up to timeout for in-flight
+// calls to finish before closing all connections. It returns false if
+// calls had to be aborted.
+func (s *nonBlockingGRPCServer) Shutdown(timeout time.Duration) bool {
+	if inFlight := s.InFlight(); len(inFlight) > 0 {
+		logging.InfoS("waiting for in-flight calls", "timeout", timeout, "calls", inFlight)
+	}
+	stopped := make(chan struct{})
+	go func() {
+		s.Stop()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+		return true
+	case <-time.After(timeout):
+		logging.WarningS("aborting in-flight calls", "timeout", timeout, "calls", s.InFlight())
+		s.ForceStop()
+		return false
+	}
+}
+
+// InFlight returns the number of running calls per method
+func (s *nonBlockingGRPCServer) InFlight() map[string]int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	inFlight := map[string]int{}
+	for method, n := range s.inFlight {
+		inFlight[method] = n
+	}
+	return inFlight
+}
+
+func (s *nonBlockingGRPCServer) trackInFlight(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	s.mu.Lock()
+	s.inFlight[info.FullMethod]++
+	s.mu.Unlock()
+	defer func() {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		if s.inFlight[info.FullMethod]--; s.inFlight[info.FullMethod] == 0 {
+			delete(s.inFlight, info.FullMethod)
+		}
+	}()
+	return handler(ctx, req)
+}
+
+// logGRPC logs every call, requests and responses are logged
+// with all fields marked as csi_secret stripped
+func logGRPC(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	start := time.Now()
+	logging.V(3).InfoS("GRPC call", "method", info.FullMethod)
+	logging.V(5).InfoS("GRPC request", "method", info.FullMethod, "request", protosanitizer.StripSecrets(req))
+	resp, err := handler(ctx, req)
+	if err != nil {
+		logging.ErrorS(err, "GRPC error", "method", info.FullMethod, "duration", time.Since(start))
+	} else {
+		logging.V(5).InfoS("GRPC response", "method", info.FullMethod, "response", protosanitizer.StripSecrets(resp), "duration", time.Since(start))
+	}
+	return resp, err
+}
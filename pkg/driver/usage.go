@@ -0,0 +1,193 @@
+package driver
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/ctrox/csi-s3/pkg/config"
+	"github.com/ctrox/csi-s3/pkg/kube"
+	"github.com/ctrox/csi-s3/pkg/logging"
+	"github.com/ctrox/csi-s3/pkg/metrics"
+	"github.com/ctrox/csi-s3/pkg/s3"
+	corev1 "k8s.io/api/core/v1"
+)
+
+const (
+	// deletionSecretNameKey and deletionSecretNamespaceKey are the annotations
+	// the external-provisioner records the provisioner secret of a volume in
+	deletionSecretNameKey      = "volume.kubernetes.io/provisioner-deletion-secret-name"
+	deletionSecretNamespaceKey = "volume.kubernetes.io/provisioner-deletion-secret-namespace"
+	// reasonCapacityExceeded and reasonCapacityRestored are the
+	// reasons of the events about the usage of a volume
+	reasonCapacityExceeded = "CapacityExceeded"
+	reasonCapacityRestored = "CapacityRestored"
+)
+
+// kubeClient is the part of the Kubernetes API the controller uses
+type kubeClient interface {
+	PersistentVolumes(driverName string) ([]corev1.PersistentVolume, error)
+	Secret(namespace, name string) (map[string]string, error)
+	RecordEvent(object corev1.ObjectReference, component, eventType, reason, message string) error
+}
+
+var _ kubeClient = &kube.Client{}
+
+// runUsage measures the usage of all volumes every UsageInterval
+func (cs *controllerServer) runUsage(stop <-chan struct{}) {
+	for {
+		interval := config.Get().UsageInterval.Duration
+		enabled := interval > 0
+		if !enabled {
+			// check again later in case the configuration changes
+			interval = time.Minute
+		}
+		select {
+		case <-stop:
+			return
+		case <-time.After(interval):
+		}
+		if enabled {
+			cs.measureUsage()
+		}
+	}
+}
+
+// measureUsage records the usage of the persistent volumes of the driver
+// in their metadata and metrics and reports volumes exceeding their capacity
+func (cs *controllerServer) measureUsage() {
+	volumes, err := cs.kube.PersistentVolumes(cs.driverName)
+	if err != nil {
+		logging.ErrorS(err, "failed to list persistent volumes")
+		return
+	}
+	if cs.exceeded == nil {
+		cs.exceeded = map[string]bool{}
+		cs.quotas = map[string]int64{}
+	}
+	found := map[string]bool{}
+	for i := range volumes {
+		pv := &volumes[i]
+		found[pv.Name] = true
+		if err := cs.measureVolume(pv); err != nil {
+			logging.ErrorS(err, "failed to measure usage of volume", "volumeID", pv.Spec.CSI.VolumeHandle, "pv", pv.Name)
+		}
+	}
+	// forget the volumes which have been deleted
+	for name := range cs.exceeded {
+		if !found[name] {
+			delete(cs.exceeded, name)
+			delete(cs.quotas, name)
+			metrics.VolumeUsedBytes.DeleteLabelValues(name)
+			metrics.VolumeCapacityBytes.DeleteLabelValues(name)
+		}
+	}
+}
+
+// measureVolume measures the usage of the bucket or prefix of pv. The usage
+// is only recorded in the metadata if it is stored in the bucket, statically
+// provisioned volumes and the context metadata store are left alone.
+func (cs *controllerServer) measureVolume(pv *corev1.PersistentVolume) error {
+	name := pv.Name
+	volumeID := pv.Spec.CSI.VolumeHandle
+	volumeContext := pv.Spec.CSI.VolumeAttributes
+	handle, err := parseVolumeID(volumeID)
+	if err != nil {
+		return err
+	}
+	var secrets map[string]string
+	if secretName := pv.Annotations[deletionSecretNameKey]; secretName != "" {
+		if secrets, err = cs.kube.Secret(pv.Annotations[deletionSecretNamespaceKey], secretName); err != nil {
+			return fmt.Errorf("failed to get secret: %w", err)
+		}
+	}
+	cfg, err := s3Config(secrets, volumeProfile(volumeID, volumeContext))
+	if err != nil {
+		return err
+	}
+	client, err := cs.newClient(cfg)
+	if err != nil {
+		return fmt.Errorf("failed to initialize S3 client: %w", err)
+	}
+	storeType := volumeContext[s3.MetaStoreKey]
+	store, err := client.MetaStore(storeType, volumeContext)
+	if err != nil {
+		return err
+	}
+	meta, err := store.GetFSMeta(handle.bucket, handle.prefix)
+	stored := err == nil && storeType != s3.MetaStoreContext
+	if errors.Is(err, s3.ErrFSMetaNotFound) {
+		meta, err = metaFromVolumeContext(volumeContext, handle.bucket, handle.prefix)
+	}
+	if err != nil {
+		return err
+	}
+
+	used, err := client.PrefixUsage(meta.BucketName, meta.Prefix)
+	if err != nil {
+		return err
+	}
+	metrics.VolumeUsedBytes.WithLabelValues(name).Set(float64(used))
+	metrics.VolumeCapacityBytes.WithLabelValues(name).Set(float64(meta.CapacityBytes))
+	exceeded := meta.CapacityBytes > 0 && used > meta.CapacityBytes
+	previous, known := cs.exceeded[name]
+	if !known {
+		previous = meta.CapacityExceeded
+	}
+	cs.exceeded[name] = exceeded
+	if exceeded != previous {
+		cs.recordUsageEvent(pv, meta, used, exceeded)
+	}
+
+	// the bucket quota is only set again if the capacity of the volume changes
+	quota := meta.QuotaBytes
+	if applied, known := cs.quotas[name]; known {
+		quota = applied
+	}
+	if meta.QuotaEnforcement == s3.QuotaBucket && meta.CapacityBytes > 0 && quota != meta.CapacityBytes {
+		if err := client.SetBucketQuota(meta.BucketName, meta.CapacityBytes); err != nil {
+			return fmt.Errorf("failed to set bucket quota: %w", err)
+		}
+		quota = meta.CapacityBytes
+		cs.quotas[name] = quota
+	}
+
+	if stored && (meta.UsedBytes != used || meta.CapacityExceeded != exceeded || meta.QuotaBytes != quota) {
+		meta.UsedBytes = used
+		meta.CapacityExceeded = exceeded
+		meta.QuotaBytes = quota
+		if err := store.SetFSMeta(meta); err != nil {
+			if errors.Is(err, s3.ErrFSMetaConflict) {
+				// the usage is recorded the next time
+				logging.V(4).InfoS("metadata of volume has been modified concurrently", "volumeID", volumeID, "pv", name)
+			} else if errors.Is(err, s3.ErrFSMetaNewer) {
+				logging.V(4).InfoS("metadata of volume has been written by a newer driver, usage is not recorded", "volumeID", volumeID, "pv", name)
+			} else {
+				return fmt.Errorf("failed to record usage: %w", err)
+			}
+		}
+	}
+	return nil
+}
+
+// recordUsageEvent reports that pv has exceeded its capacity or is back
+// within it on its claim or, if it has none, on the volume itself
+func (cs *controllerServer) recordUsageEvent(pv *corev1.PersistentVolume, meta *s3.FSMeta, used int64, exceeded bool) {
+	object := corev1.ObjectReference{Kind: "PersistentVolume", APIVersion: "v1", Name: pv.Name, UID: pv.UID}
+	if claim := pv.Spec.ClaimRef; claim != nil {
+		object = corev1.ObjectReference{Kind: "PersistentVolumeClaim", APIVersion: "v1", Namespace: claim.Namespace, Name: claim.Name, UID: claim.UID}
+	}
+	eventType, reason := corev1.EventTypeNormal, reasonCapacityRestored
+	message := fmt.Sprintf("volume %s uses %d bytes and is within its capacity of %d bytes again", pv.Name, used, meta.CapacityBytes)
+	if exceeded {
+		eventType, reason = corev1.EventTypeWarning, reasonCapacityExceeded
+		message = fmt.Sprintf("volume %s uses %d bytes, more than its capacity of %d bytes", pv.Name, used, meta.CapacityBytes)
+		if meta.QuotaEnforcement == s3.QuotaReadOnly {
+			message += ", it is published read only until data is removed"
+		}
+	}
+	logging.InfoS(message, "reason", reason, "volumeID", pv.Spec.CSI.VolumeHandle, "pv", pv.Name)
+	if err := cs.kube.RecordEvent(object, cs.driverName, eventType, reason, message); err != nil {
+		logging.ErrorS(err, "failed to record event of volume", "volumeID", pv.Spec.CSI.VolumeHandle, "pv", pv.Name)
+	}
+}
@@ -0,0 +1,153 @@
+package driver
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/ctrox/csi-s3/pkg/s3"
+	"golang.org/x/net/context"
+	corev1 "k8s.io/api/core/v1"
+)
+
+type fakeKube struct {
+	volumes []corev1.PersistentVolume
+	events  []string
+}
+
+func (f *fakeKube) PersistentVolumes(driverName string) ([]corev1.PersistentVolume, error) {
+	return f.volumes, nil
+}
+
+func (f *fakeKube) Secret(namespace, name string) (map[string]string, error) {
+	if namespace != "kube-system" || name != "csi-s3-secret" {
+		return nil, errors.New("secret not found")
+	}
+	return map[string]string{}, nil
+}
+
+func (f *fakeKube) RecordEvent(object corev1.ObjectReference, component, eventType, reason, message string) error {
+	f.events = append(f.events, object.Kind+"/"+object.Name+" "+reason)
+	return nil
+}
+
+// addVolume adds a persistent volume claimed by claim-<name> for volume
+func (f *fakeKube) addVolume(name string, volume *csi.Volume) {
+	pv := corev1.PersistentVolume{}
+	pv.Name = name
+	pv.Annotations = map[string]string{
+		deletionSecretNameKey:      "csi-s3-secret",
+		deletionSecretNamespaceKey: "kube-system",
+	}
+	pv.Spec.CSI = &corev1.CSIPersistentVolumeSource{
+		Driver:           driverName,
+		VolumeHandle:     volume.GetVolumeId(),
+		VolumeAttributes: volume.GetVolumeContext(),
+	}
+	pv.Spec.ClaimRef = &corev1.ObjectReference{Kind: "PersistentVolumeClaim", Namespace: "default", Name: "claim-" + name}
+	f.volumes = append(f.volumes, pv)
+}
+
+func TestMeasureUsage(t *testing.T) {
+	store := s3.NewFakeObjectStore()
+	cs := newTestControllerServer(store)
+	kc := &fakeKube{}
+	cs.kube = kc
+	for _, req := range []*csi.CreateVolumeRequest{
+		createVolumeRequest("pvc-1", map[string]string{"quotaEnforcement": "read-only"}),
+		createVolumeRequest("pvc-2", map[string]string{"quotaEnforcement": "bucket-quota"}),
+	} {
+		resp, err := cs.CreateVolume(context.Background(), req)
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		kc.addVolume(req.GetName(), resp.GetVolume())
+	}
+	store.PutObject("pvc-1", "csi-fs/file", make([]byte, 2048))
+
+	cs.measureUsage()
+	meta, err := store.GetFSMeta("pvc-1", "")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if !meta.CapacityExceeded || meta.UsedBytes < 2048 {
+		t.Errorf("expected exceeded usage to be recorded, got %d bytes and exceeded %v", meta.UsedBytes, meta.CapacityExceeded)
+	}
+	if quota := store.BucketQuota("pvc-2"); quota != 1024 {
+		t.Errorf("expected bucket quota of 1024 bytes, got %d", quota)
+	}
+	if quota := store.BucketQuota("pvc-1"); quota != 0 {
+		t.Errorf("expected no bucket quota for read-only enforcement, got %d", quota)
+	}
+
+	// the state is only reported when it changes
+	cs.measureUsage()
+	store.RemovePrefix("pvc-1", "csi-fs")
+	cs.measureUsage()
+	expected := []string{
+		"PersistentVolumeClaim/claim-pvc-1 " + reasonCapacityExceeded,
+		"PersistentVolumeClaim/claim-pvc-1 " + reasonCapacityRestored,
+	}
+	if !reflect.DeepEqual(kc.events, expected) {
+		t.Errorf("expected events %v, got %v", expected, kc.events)
+	}
+	if meta, _ := store.GetFSMeta("pvc-1", ""); meta.CapacityExceeded {
+		t.Error("expected volume to be within its capacity again")
+	}
+
+	// deleted volumes are forgotten
+	kc.volumes = kc.volumes[1:]
+	cs.measureUsage()
+	if _, ok := cs.exceeded["pvc-1"]; ok {
+		t.Error("expected deleted volume to be forgotten")
+	}
+}
+
+func TestMeasureUsageBucketQuota(t *testing.T) {
+	store := s3.NewFakeObjectStore()
+	cs := newTestControllerServer(store)
+	kc := &fakeKube{}
+	cs.kube = kc
+	req := createVolumeRequest("pvc-1", map[string]string{"quotaEnforcement": "bucket-quota"})
+	resp, err := cs.CreateVolume(context.Background(), req)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	kc.addVolume(req.GetName(), resp.GetVolume())
+
+	cs.measureUsage()
+	if meta, _ := store.GetFSMeta("pvc-1", ""); meta.QuotaBytes != 1024 {
+		t.Errorf("expected the quota to be recorded in the metadata, got %d", meta.QuotaBytes)
+	}
+
+	// the quota is not set again, neither by the same nor by a restarted controller
+	store.SetError("SetBucketQuota", errors.New("quota set again"))
+	if err := cs.measureVolume(&kc.volumes[0]); err != nil {
+		t.Errorf("unexpected error: %s", err)
+	}
+	restarted := newTestControllerServer(store)
+	restarted.kube = kc
+	restarted.exceeded, restarted.quotas = map[string]bool{}, map[string]int64{}
+	if err := restarted.measureVolume(&kc.volumes[0]); err != nil {
+		t.Errorf("unexpected error after a restart: %s", err)
+	}
+
+	// it is set again once the capacity changes
+	store.SetError("SetBucketQuota", nil)
+	meta, err := store.GetFSMeta("pvc-1", "")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	meta.CapacityBytes = 2048
+	if err := store.SetFSMeta(meta); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	cs.measureUsage()
+	if quota := store.BucketQuota("pvc-1"); quota != 2048 {
+		t.Errorf("expected bucket quota of 2048 bytes, got %d", quota)
+	}
+	if meta, _ := store.GetFSMeta("pvc-1", ""); meta.QuotaBytes != 2048 {
+		t.Errorf("expected the new quota to be recorded in the metadata, got %d", meta.QuotaBytes)
+	}
+}
@@ -0,0 +1,87 @@
+package driver
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+
+	"github.com/ctrox/csi-s3/pkg/logging"
+	"github.com/ctrox/csi-s3/pkg/mounter"
+	"github.com/ctrox/csi-s3/pkg/s3"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// capacityKey is the size in bytes of a volume described by its volume context
+const capacityKey = "capacity"
+
+// metaFromVolumeContext builds the FSMeta of a volume which has no metadata
+// object from its volume context. bucketName and prefix are used unless
+// they are set in the context. The volume is mounted at the root of the
+// bucket or prefix as it is expected to contain existing data.
+func metaFromVolumeContext(volumeContext map[string]string, bucketName, prefix string) (*s3.FSMeta, error) {
+	meta := &s3.FSMeta{
+		BucketName: bucketName,
+		Prefix:     prefix,
+		Profile:    volumeContext[s3.ProfileKey],
+		Mounter:    volumeContext[mounter.TypeKey],
+		UID:        volumeContext[mounter.UIDKey],
+		GID:        volumeContext[mounter.GIDKey],
+		Umask:      volumeContext[mounter.UmaskKey],
+		DirMode:    volumeContext[mounter.DirModeKey],
+		FileMode:   volumeContext[mounter.FileModeKey],
+	}
+	if b, ok := volumeContext[mounter.BucketKey]; ok && b != "" {
+		meta.BucketName = b
+	}
+	if p, ok := volumeContext[mounter.VolumePrefix]; ok {
+		meta.Prefix = p
+	}
+	meta.UsePrefix = meta.Prefix != ""
+	if usePrefix, ok := volumeContext[mounter.UsePrefix]; ok {
+		v, err := strconv.ParseBool(usePrefix)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s %q: %s", mounter.UsePrefix, usePrefix, err)
+		}
+		meta.UsePrefix = v
+	}
+	if capacity, ok := volumeContext[capacityKey]; ok {
+		v, err := strconv.ParseInt(capacity, 10, 64)
+		if err != nil || v < 0 {
+			return nil, fmt.Errorf("invalid %s %q: must be a size in bytes", capacityKey, capacity)
+		}
+		meta.CapacityBytes = v
+	}
+	if meta.BucketName == "" {
+		return nil, fmt.Errorf("%s is required", mounter.BucketKey)
+	}
+	if err := mounter.ValidateOwnership(meta); err != nil {
+		return nil, err
+	}
+	return meta, nil
+}
+
+// getFSMeta returns the metadata stored for the volume. Statically provisioned
+// volumes of existing buckets may have none, their metadata is built from the
+// volume context instead and not written back, the bucket might be read only.
+func getFSMeta(store s3.MetaStore, volumeID string, volumeContext map[string]string) (*s3.FSMeta, error) {
+	handle, err := parseVolumeID(volumeID)
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	bucketName, prefix := handle.bucket, handle.prefix
+	meta, err := store.GetFSMeta(bucketName, prefix)
+	if err == nil {
+		return meta, nil
+	}
+	if !errors.Is(err, s3.ErrFSMetaNotFound) {
+		return nil, err
+	}
+	logging.InfoS("volume has no metadata, using its volume context", "volumeID", volumeID)
+	meta, err = metaFromVolumeContext(volumeContext, bucketName, prefix)
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, fmt.Sprintf("volume %s has no metadata and its volume context is invalid: %s", volumeID, err))
+	}
+	meta.Profile = volumeProfile(volumeID, volumeContext)
+	return meta, nil
+}
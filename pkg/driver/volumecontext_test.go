@@ -0,0 +1,85 @@
+package driver
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/ctrox/csi-s3/pkg/s3"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+type fakeFSMetaGetter struct {
+	meta *s3.FSMeta
+	err  error
+}
+
+func (f *fakeFSMetaGetter) GetFSMeta(bucketName, prefix string) (*s3.FSMeta, error) {
+	return f.meta, f.err
+}
+
+func (f *fakeFSMetaGetter) SetFSMeta(meta *s3.FSMeta) error {
+	return f.err
+}
+
+func TestGetFSMetaFallback(t *testing.T) {
+	stored := &s3.FSMeta{BucketName: "bucket", Mounter: "s3fs", FSPath: "csi-fs"}
+	meta, err := getFSMeta(&fakeFSMetaGetter{meta: stored}, "bucket", map[string]string{"mounter": "rclone"})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if meta != stored {
+		t.Errorf("expected stored metadata, got %+v", meta)
+	}
+
+	missing := &fakeFSMetaGetter{err: s3.ErrFSMetaNotFound}
+	meta, err = getFSMeta(missing, "bucket/data", map[string]string{
+		"mounter":  "rclone",
+		"capacity": "1073741824",
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if meta.BucketName != "bucket" || meta.Prefix != "data" || !meta.UsePrefix {
+		t.Errorf("expected bucket and prefix of the volume ID, got %+v", meta)
+	}
+	if meta.Mounter != "rclone" || meta.CapacityBytes != 1073741824 || meta.FSPath != "" {
+		t.Errorf("unexpected metadata from volume context: %+v", meta)
+	}
+
+	wrapped := &fakeFSMetaGetter{err: fmt.Errorf("context store: %w", s3.ErrFSMetaNotFound)}
+	meta, err = getFSMeta(wrapped, "bucket", map[string]string{"mounter": "rclone"})
+	if err != nil {
+		t.Fatalf("expected wrapped not found error to use the volume context, got %s", err)
+	}
+	if meta.BucketName != "bucket" || meta.Mounter != "rclone" {
+		t.Errorf("unexpected metadata from volume context: %+v", meta)
+	}
+
+	meta, err = getFSMeta(missing, "pv-handle", map[string]string{
+		"bucket":    "data",
+		"prefix":    "",
+		"usePrefix": "true",
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if meta.BucketName != "data" || meta.Prefix != "" || !meta.UsePrefix {
+		t.Errorf("expected bucket and prefix of the volume context, got %+v", meta)
+	}
+
+	for _, volumeContext := range []map[string]string{
+		{"capacity": "1Gi"},
+		{"usePrefix": "maybe"},
+		{"uid": "nobody"},
+	} {
+		if _, err := getFSMeta(missing, "bucket", volumeContext); status.Code(err) != codes.InvalidArgument {
+			t.Errorf("expected InvalidArgument for %v, got %v", volumeContext, err)
+		}
+	}
+
+	if _, err := getFSMeta(&fakeFSMetaGetter{err: errors.New("access denied")}, "bucket", nil); err == nil || status.Code(err) == codes.InvalidArgument {
+		t.Errorf("expected other errors to be returned, got %v", err)
+	}
+}
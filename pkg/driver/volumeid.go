@@ -0,0 +1,59 @@
+package driver
+
+import (
+	"fmt"
+	"strings"
+)
+
+const (
+	// volumeIDVersion is the first segment of the IDs of volumes created by
+	// the controller. Bucket names are at least 3 characters long, so it
+	// cannot be mistaken for the bucket of an unversioned ID.
+	volumeIDVersion = "v1"
+)
+
+// volumeHandle is the endpoint profile, bucket and prefix
+// a volume ID refers to. DeleteVolume only gets the volume ID,
+// so all of them have to be part of it.
+type volumeHandle struct {
+	profile string
+	bucket  string
+	prefix  string
+}
+
+// String returns the versioned volume ID v1/<profile>/<bucket>/<prefix>.
+// The profile is empty for volumes of the default endpoint and the
+// prefix may contain any number of slashes.
+func (h volumeHandle) String() string {
+	parts := []string{volumeIDVersion, h.profile, h.bucket}
+	if h.prefix != "" {
+		parts = append(parts, h.prefix)
+	}
+	return strings.Join(parts, "/")
+}
+
+// parseVolumeID returns the handle of volumeID. Unversioned IDs like
+// <bucket>[/<prefix>] have been created by earlier releases
+// and are used as volumeHandle of statically provisioned volumes.
+func parseVolumeID(volumeID string) (volumeHandle, error) {
+	parts := strings.SplitN(volumeID, "/", 4)
+	// only the known version is matched, buckets may be named like v10
+	if parts[0] == volumeIDVersion {
+		if len(parts) < 3 || parts[2] == "" {
+			return volumeHandle{}, fmt.Errorf("volume ID %s has no bucket", volumeID)
+		}
+		h := volumeHandle{profile: parts[1], bucket: parts[2]}
+		if len(parts) == 4 {
+			h.prefix = parts[3]
+		}
+		return h, nil
+	}
+
+	var h volumeHandle
+	h.bucket = volumeID
+	// everything after the first slash is the prefix, it may be nested
+	if i := strings.Index(volumeID, "/"); i >= 0 {
+		h.bucket, h.prefix = volumeID[:i], volumeID[i+1:]
+	}
+	return h, nil
+}
@@ -0,0 +1,48 @@
+package driver
+
+import "testing"
+
+func TestParseVolumeID(t *testing.T) {
+	for _, tc := range []struct {
+		volumeID string
+		handle   volumeHandle
+		// versioned is the ID created for the handle by this release
+		versioned string
+	}{
+		{volumeID: "v1//pvc-1", handle: volumeHandle{bucket: "pvc-1"}},
+		{volumeID: "v1//bucket/pvc-1", handle: volumeHandle{bucket: "bucket", prefix: "pvc-1"}},
+		{volumeID: "v1/minio/bucket/pvc-1", handle: volumeHandle{profile: "minio", bucket: "bucket", prefix: "pvc-1"}},
+		{volumeID: "v1//bucket/team/app/data", handle: volumeHandle{bucket: "bucket", prefix: "team/app/data"}},
+		{volumeID: "v1/minio/bucket/a:b/c", handle: volumeHandle{profile: "minio", bucket: "bucket", prefix: "a:b/c"}},
+		// unversioned IDs of earlier releases and static volumes
+		{volumeID: "pvc-1", handle: volumeHandle{bucket: "pvc-1"}, versioned: "v1//pvc-1"},
+		{volumeID: "bucket/pvc-1", handle: volumeHandle{bucket: "bucket", prefix: "pvc-1"}, versioned: "v1//bucket/pvc-1"},
+		{volumeID: "bucket/team/app/data", handle: volumeHandle{bucket: "bucket", prefix: "team/app/data"}, versioned: "v1//bucket/team/app/data"},
+		// only versioned IDs hold a profile
+		{volumeID: "minio:bucket/pvc-1", handle: volumeHandle{bucket: "minio:bucket", prefix: "pvc-1"}, versioned: "v1//minio:bucket/pvc-1"},
+		{volumeID: "bucket/pre:fix", handle: volumeHandle{bucket: "bucket", prefix: "pre:fix"}, versioned: "v1//bucket/pre:fix"},
+		{volumeID: "v10/data", handle: volumeHandle{bucket: "v10", prefix: "data"}, versioned: "v1//v10/data"},
+		{volumeID: "v2024", handle: volumeHandle{bucket: "v2024"}, versioned: "v1//v2024"},
+	} {
+		h, err := parseVolumeID(tc.volumeID)
+		if err != nil {
+			t.Errorf("unexpected error parsing %q: %s", tc.volumeID, err)
+			continue
+		}
+		if h != tc.handle {
+			t.Errorf("parseVolumeID(%q) = %+v, want %+v", tc.volumeID, h, tc.handle)
+		}
+		versioned := tc.versioned
+		if versioned == "" {
+			versioned = tc.volumeID
+		}
+		if id := h.String(); id != versioned {
+			t.Errorf("%+v.String() = %q, want %q", h, id, versioned)
+		}
+	}
+	for _, volumeID := range []string{"v1", "v1/minio", "v1/minio/"} {
+		if _, err := parseVolumeID(volumeID); err == nil {
+			t.Errorf("expected error parsing %q", volumeID)
+		}
+	}
+}
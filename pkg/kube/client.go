@@ -0,0 +1,101 @@
+package kube
+
+import (
+	"context"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+)
+
+const (
+	requestTimeout = 30 * time.Second
+	// listLimit is the number of objects listed per request
+	listLimit = 500
+)
+
+// ErrNotInCluster is returned by InClusterClient outside of a pod
+var ErrNotInCluster = rest.ErrNotInCluster
+
+// Client wraps the few calls the controller makes to the Kubernetes API
+type Client struct {
+	clientset kubernetes.Interface
+}
+
+// NewClient returns a client which calls the API with clientset
+func NewClient(clientset kubernetes.Interface) *Client {
+	return &Client{clientset: clientset}
+}
+
+// InClusterClient returns a client with the service account of the pod
+func InClusterClient() (*Client, error) {
+	cfg, err := rest.InClusterConfig()
+	if err != nil {
+		return nil, err
+	}
+	cfg.Timeout = requestTimeout
+	clientset, err := kubernetes.NewForConfig(cfg)
+	if err != nil {
+		return nil, err
+	}
+	return NewClient(clientset), nil
+}
+
+// PersistentVolumes returns the persistent volumes of the CSI driver driverName
+func (c *Client) PersistentVolumes(driverName string) ([]corev1.PersistentVolume, error) {
+	volumes := []corev1.PersistentVolume{}
+	opts := metav1.ListOptions{Limit: listLimit}
+	for {
+		list, err := c.clientset.CoreV1().PersistentVolumes().List(context.Background(), opts)
+		if err != nil {
+			return nil, err
+		}
+		for _, pv := range list.Items {
+			if pv.Spec.CSI != nil && pv.Spec.CSI.Driver == driverName {
+				volumes = append(volumes, pv)
+			}
+		}
+		if list.Continue == "" {
+			return volumes, nil
+		}
+		opts.Continue = list.Continue
+	}
+}
+
+// Secret returns the data of a secret
+func (c *Client) Secret(namespace, name string) (map[string]string, error) {
+	secret, err := c.clientset.CoreV1().Secrets(namespace).Get(context.Background(), name, metav1.GetOptions{})
+	if err != nil {
+		return nil, err
+	}
+	data := map[string]string{}
+	for k, v := range secret.Data {
+		data[k] = string(v)
+	}
+	return data, nil
+}
+
+// RecordEvent creates an event of eventType about object from component
+func (c *Client) RecordEvent(object corev1.ObjectReference, component, eventType, reason, message string) error {
+	namespace := object.Namespace
+	if namespace == "" {
+		// events of cluster scoped objects are kept in the default namespace
+		namespace = metav1.NamespaceDefault
+	}
+	now := metav1.Now()
+	event := &corev1.Event{
+		ObjectMeta:     metav1.ObjectMeta{GenerateName: object.Name + ".", Namespace: namespace},
+		InvolvedObject: object,
+		Reason:         reason,
+		Message:        message,
+		Type:           eventType,
+		Source:         corev1.EventSource{Component: component},
+		FirstTimestamp: now,
+		LastTimestamp:  now,
+		Count:          1,
+	}
+	_, err := c.clientset.CoreV1().Events(namespace).Create(context.Background(), event, metav1.CreateOptions{})
+	return err
+}
@@ -0,0 +1,108 @@
+package kube
+
+import (
+	"context"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+func TestPersistentVolumes(t *testing.T) {
+	clientset := fake.NewClientset(
+		&corev1.PersistentVolume{
+			ObjectMeta: metav1.ObjectMeta{Name: "pv-1"},
+			Spec: corev1.PersistentVolumeSpec{
+				PersistentVolumeSource: corev1.PersistentVolumeSource{
+					CSI: &corev1.CSIPersistentVolumeSource{Driver: "ch.ctrox.csi.s3-driver", VolumeHandle: "v1//bucket/pv-1"},
+				},
+				ClaimRef: &corev1.ObjectReference{Namespace: "ns", Name: "data"},
+			},
+		},
+		&corev1.PersistentVolume{
+			ObjectMeta: metav1.ObjectMeta{Name: "pv-2"},
+			Spec: corev1.PersistentVolumeSpec{
+				PersistentVolumeSource: corev1.PersistentVolumeSource{
+					CSI: &corev1.CSIPersistentVolumeSource{Driver: "other", VolumeHandle: "pv-2"},
+				},
+			},
+		},
+		&corev1.PersistentVolume{
+			ObjectMeta: metav1.ObjectMeta{Name: "pv-3"},
+			Spec: corev1.PersistentVolumeSpec{
+				PersistentVolumeSource: corev1.PersistentVolumeSource{
+					HostPath: &corev1.HostPathVolumeSource{Path: "/"},
+				},
+			},
+		},
+	)
+	// the fake clientset does not paginate, continue the list once
+	var continues []string
+	clientset.PrependReactor("list", "persistentvolumes", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		opts := action.(k8stesting.ListActionImpl).ListOptions
+		continues = append(continues, opts.Continue)
+		if opts.Continue == "" {
+			list := &corev1.PersistentVolumeList{}
+			list.Continue = "next"
+			return true, list, nil
+		}
+		return false, nil, nil
+	})
+
+	volumes, err := NewClient(clientset).PersistentVolumes("ch.ctrox.csi.s3-driver")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if len(volumes) != 1 || volumes[0].Name != "pv-1" || volumes[0].Spec.CSI.VolumeHandle != "v1//bucket/pv-1" {
+		t.Errorf("expected only the volume of the driver, got %+v", volumes)
+	}
+	if ref := volumes[0].Spec.ClaimRef; ref == nil || ref.Namespace != "ns" || ref.Name != "data" {
+		t.Errorf("unexpected claim %+v", ref)
+	}
+	if len(continues) != 2 || continues[1] != "next" {
+		t.Errorf("expected the list to be continued, got %v", continues)
+	}
+}
+
+func TestSecret(t *testing.T) {
+	client := NewClient(fake.NewClientset(&corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "kube-system", Name: "csi-s3-secret"},
+		Data:       map[string][]byte{"accessKeyID": []byte("key")},
+	}))
+
+	secret, err := client.Secret("kube-system", "csi-s3-secret")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if secret["accessKeyID"] != "key" {
+		t.Errorf("expected decoded secret, got %v", secret)
+	}
+	if _, err := client.Secret("kube-system", "missing"); err == nil {
+		t.Error("expected an error for a missing secret")
+	}
+}
+
+func TestRecordEvent(t *testing.T) {
+	clientset := fake.NewClientset()
+	client := NewClient(clientset)
+
+	pv := corev1.ObjectReference{Kind: "PersistentVolume", APIVersion: "v1", Name: "pv-1"}
+	if err := client.RecordEvent(pv, "csi-s3", corev1.EventTypeWarning, "CapacityExceeded", "too big"); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	events, err := clientset.CoreV1().Events(metav1.NamespaceDefault).List(context.Background(), metav1.ListOptions{})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if len(events.Items) != 1 {
+		t.Fatalf("expected event of a cluster scoped object in the default namespace, got %+v", events.Items)
+	}
+	event := events.Items[0]
+	if event.InvolvedObject != pv || event.Type != corev1.EventTypeWarning || event.Reason != "CapacityExceeded" ||
+		event.Source.Component != "csi-s3" || event.GenerateName != "pv-1." || event.FirstTimestamp.IsZero() {
+		t.Errorf("unexpected event %+v", event)
+	}
+}
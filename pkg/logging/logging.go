@@ -0,0 +1,194 @@
+package logging
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+const (
+	// FormatText logs key/value pairs through glog
+	FormatText = "text"
+	// FormatJSON logs one json object per line to stderr
+	FormatJSON = "json"
+
+	redacted = "***stripped***"
+)
+
+var (
+	format = FormatText
+	// output is where json lines are written to
+	output io.Writer = os.Stderr
+	// mu serializes json lines written to output
+	mu sync.Mutex
+	// sensitiveKeys are matched case insensitive against keys of logged
+	// arguments, their values are replaced before logging
+	sensitiveKeys = []string{"secret", "password", "passwd", "token", "credential", "accesskey", "access_key", "access-key"}
+)
+
+// SetFormat sets the output format of structured logs
+func SetFormat(f string) error {
+	switch f {
+	case FormatText, FormatJSON:
+		format = f
+		return nil
+	default:
+		return fmt.Errorf("unknown log format %s, must be one of %s, %s", f, FormatText, FormatJSON)
+	}
+}
+
+// Verbose logs only if the glog verbosity is high enough
+type Verbose bool
+
+// V returns a Verbose which logs if the verbosity is at least level
+func V(level glog.Level) Verbose {
+	return Verbose(glog.V(level))
+}
+
+// InfoS logs msg with the key/value pairs if v is enabled
+func (v Verbose) InfoS(msg string, keysAndValues ...interface{}) {
+	if v {
+		log("info", msg, keysAndValues)
+	}
+}
+
+// InfoS logs msg with the key/value pairs
+func InfoS(msg string, keysAndValues ...interface{}) {
+	log("info", msg, keysAndValues)
+}
+
+// WarningS logs msg with the key/value pairs
+func WarningS(msg string, keysAndValues ...interface{}) {
+	log("warning", msg, keysAndValues)
+}
+
+// ErrorS logs msg and err with the key/value pairs
+func ErrorS(err error, msg string, keysAndValues ...interface{}) {
+	log("error", msg, append([]interface{}{"err", err}, keysAndValues...))
+}
+
+// FatalS logs msg and err with the key/value pairs and exits
+func FatalS(err error, msg string, keysAndValues ...interface{}) {
+	log("fatal", msg, append([]interface{}{"err", err}, keysAndValues...))
+	// glog exits itself after logging fatal text entries
+	glog.Flush()
+	os.Exit(255)
+}
+
+func log(level string, msg string, keysAndValues []interface{}) {
+	if format == FormatJSON {
+		logJSON(level, msg, keysAndValues)
+		return
+	}
+	var b strings.Builder
+	b.WriteString(msg)
+	for i := 0; i < len(keysAndValues); i += 2 {
+		key, value := pair(keysAndValues, i)
+		fmt.Fprintf(&b, " %s=%q", key, fmt.Sprint(value))
+	}
+	// depth 2 reports the caller of InfoS, WarningS, ErrorS or FatalS
+	switch level {
+	case "fatal":
+		glog.FatalDepth(2, b.String())
+	case "error":
+		glog.ErrorDepth(2, b.String())
+	case "warning":
+		glog.WarningDepth(2, b.String())
+	default:
+		glog.InfoDepth(2, b.String())
+	}
+}
+
+func logJSON(level string, msg string, keysAndValues []interface{}) {
+	entry := map[string]interface{}{
+		"ts":    time.Now().UTC().Format(time.RFC3339Nano),
+		"level": level,
+		"msg":   msg,
+	}
+	for i := 0; i < len(keysAndValues); i += 2 {
+		key, value := pair(keysAndValues, i)
+		if err, ok := value.(error); ok {
+			value = err.Error()
+		} else if s, ok := value.(fmt.Stringer); ok {
+			value = s.String()
+		}
+		entry[key] = value
+	}
+	b, err := json.Marshal(entry)
+	if err != nil {
+		glog.Errorf("failed to marshal log entry %q: %s", msg, err)
+		return
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	fmt.Fprintln(output, string(b))
+}
+
+func pair(keysAndValues []interface{}, i int) (string, interface{}) {
+	key := fmt.Sprint(keysAndValues[i])
+	if i+1 >= len(keysAndValues) {
+		return key, "(MISSING)"
+	}
+	return key, keysAndValues[i+1]
+}
+
+// isSensitive returns true if the key looks like it holds credentials
+func isSensitive(key string) bool {
+	key = strings.ToLower(key)
+	for _, s := range sensitiveKeys {
+		if strings.Contains(key, s) {
+			return true
+		}
+	}
+	return false
+}
+
+// MaskArgs returns a copy of command line args with the values of
+// credentials replaced. Both "--key=value" and "-o key=value" as well
+// as "--key value" forms are masked.
+func MaskArgs(args []string) []string {
+	masked := make([]string, len(args))
+	maskNext := false
+	for i, arg := range args {
+		if maskNext {
+			masked[i] = redacted
+			maskNext = false
+			continue
+		}
+		masked[i] = maskOptions(arg)
+		if strings.HasPrefix(arg, "-") && !strings.Contains(arg, "=") && isSensitive(arg) {
+			maskNext = true
+		}
+	}
+	return masked
+}
+
+// maskOptions masks the values of a comma separated list of key=value options
+func maskOptions(arg string) string {
+	options := strings.Split(arg, ",")
+	for i, option := range options {
+		kv := strings.SplitN(option, "=", 2)
+		if len(kv) == 2 && isSensitive(kv[0]) {
+			options[i] = kv[0] + "=" + redacted
+		}
+	}
+	return strings.Join(options, ",")
+}
+
+// MaskMap returns a copy of m with the values of credentials replaced
+func MaskMap(m map[string]string) map[string]string {
+	masked := make(map[string]string, len(m))
+	for k, v := range m {
+		if isSensitive(k) && !strings.HasSuffix(k, "-name") && !strings.HasSuffix(k, "-namespace") {
+			v = redacted
+		}
+		masked[k] = v
+	}
+	return masked
+}
@@ -0,0 +1,95 @@
+package logging
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestMaskArgs(t *testing.T) {
+	tests := []struct {
+		args []string
+		want []string
+	}{
+		{
+			args: []string{"bucket:/prefix", "/mnt", "-o", "url=https://s3", "-o", "allow_other"},
+			want: []string{"bucket:/prefix", "/mnt", "-o", "url=https://s3", "-o", "allow_other"},
+		},
+		{
+			args: []string{"--s3-secret-access-key=abc", "--s3-access-key-id=def", "--s3-region=us-east-1"},
+			want: []string{"--s3-secret-access-key=" + redacted, "--s3-access-key-id=" + redacted, "--s3-region=us-east-1"},
+		},
+		{
+			args: []string{"--s3-session-token", "abc", "/mnt"},
+			want: []string{"--s3-session-token", redacted, "/mnt"},
+		},
+		{
+			args: []string{"-o", "allow_other,passwd_file=/tmp/pw,uid=1000"},
+			want: []string{"-o", "allow_other,passwd_file=" + redacted + ",uid=1000"},
+		},
+	}
+	for _, tt := range tests {
+		if got := MaskArgs(tt.args); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("MaskArgs(%v) = %v, want %v", tt.args, got, tt.want)
+		}
+	}
+}
+
+func TestMaskMap(t *testing.T) {
+	m := map[string]string{
+		"mounter":         "rclone",
+		"secretAccessKey": "abc",
+		"csi.storage.k8s.io/node-publish-secret-name": "csi-s3-secret",
+	}
+	want := map[string]string{
+		"mounter":         "rclone",
+		"secretAccessKey": redacted,
+		"csi.storage.k8s.io/node-publish-secret-name": "csi-s3-secret",
+	}
+	if got := MaskMap(m); !reflect.DeepEqual(got, want) {
+		t.Errorf("MaskMap() = %v, want %v", got, want)
+	}
+}
+
+func TestSetFormat(t *testing.T) {
+	defer SetFormat(FormatText)
+	if err := SetFormat(FormatJSON); err != nil {
+		t.Errorf("unexpected error: %s", err)
+	}
+	if err := SetFormat("xml"); err == nil {
+		t.Error("expected error for unknown format")
+	}
+}
+
+func TestLogJSON(t *testing.T) {
+	defer SetFormat(FormatText)
+	defer func(w io.Writer) { output = w }(output)
+	var b bytes.Buffer
+	output = &b
+	SetFormat(FormatJSON)
+
+	WarningS("volume is broken", "volumeID", "pvc-1")
+	ErrorS(errors.New("busy"), "unmount failed", "target", "/mnt")
+	lines := strings.Split(strings.TrimSpace(b.String()), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("expected 2 lines, got %q", b.String())
+	}
+	for i, expected := range []map[string]interface{}{
+		{"level": "warning", "msg": "volume is broken", "volumeID": "pvc-1"},
+		{"level": "error", "msg": "unmount failed", "err": "busy", "target": "/mnt"},
+	} {
+		entry := map[string]interface{}{}
+		if err := json.Unmarshal([]byte(lines[i]), &entry); err != nil {
+			t.Fatalf("invalid json %q: %s", lines[i], err)
+		}
+		for k, v := range expected {
+			if entry[k] != v {
+				t.Errorf("expected %s=%v, got %v", k, v, entry[k])
+			}
+		}
+	}
+}
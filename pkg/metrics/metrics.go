@@ -0,0 +1,110 @@
+package metrics
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"github.com/ctrox/csi-s3/pkg/logging"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	namespace = "csi_s3"
+	path      = "/metrics"
+)
+
+var (
+	rpcTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "rpc_total",
+		Help:      "Total number of CSI RPCs by method and status code.",
+	}, []string{"method", "code"})
+
+	rpcDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "rpc_duration_seconds",
+		Help:      "Duration of CSI RPCs by method and status code.",
+		Buckets:   []float64{0.01, 0.05, 0.1, 0.5, 1, 2.5, 5, 10, 30, 60, 120},
+	}, []string{"method", "code"})
+
+	s3OperationDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "s3_operation_duration_seconds",
+		Help:      "Duration of S3 operations issued by the driver.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"operation"})
+
+	s3OperationErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "s3_operation_errors_total",
+		Help:      "Total number of failed S3 operations issued by the driver.",
+	}, []string{"operation"})
+
+	// ActiveMounts is the number of staged volumes per mounter type
+	ActiveMounts = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "active_mounts",
+		Help:      "Number of volumes staged on this node by mounter type.",
+	}, []string{"mounter"})
+
+	// FuseRestarts counts FUSE processes which had to be restarted
+	// because their mount was found broken
+	FuseRestarts = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "fuse_restarts_total",
+		Help:      "Total number of FUSE mounts restarted after their process died.",
+	}, []string{"mounter"})
+
+	// VolumeUsedBytes is the usage of volumes measured by the controller
+	VolumeUsedBytes = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "volume_used_bytes",
+		Help:      "Total size of the objects of a volume.",
+	}, []string{"volume"})
+
+	// VolumeCapacityBytes is the capacity of volumes measured by the controller
+	VolumeCapacityBytes = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "volume_capacity_bytes",
+		Help:      "Capacity of a volume, 0 if it has none.",
+	}, []string{"volume"})
+)
+
+func init() {
+	prometheus.MustRegister(rpcTotal, rpcDuration, s3OperationDuration, s3OperationErrors, ActiveMounts, FuseRestarts,
+		VolumeUsedBytes, VolumeCapacityBytes)
+}
+
+// Serve exposes the metrics over http on address
+func Serve(address string) {
+	mux := http.NewServeMux()
+	mux.Handle(path, promhttp.Handler())
+	logging.InfoS("serving metrics", "address", address, "path", path)
+	if err := http.ListenAndServe(address, mux); err != nil {
+		logging.FatalS(err, "failed to serve metrics", "address", address)
+	}
+}
+
+// UnaryServerInterceptor records count and duration of every RPC
+func UnaryServerInterceptor(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	start := time.Now()
+	resp, err := handler(ctx, req)
+	code := status.Code(err).String()
+	rpcTotal.WithLabelValues(info.FullMethod, code).Inc()
+	rpcDuration.WithLabelValues(info.FullMethod, code).Observe(time.Since(start).Seconds())
+	return resp, err
+}
+
+// ObserveS3Operation records the duration of an S3 operation started at
+// start and whether it failed. It is meant to be deferred with a pointer
+// to the named error result of the operation.
+func ObserveS3Operation(operation string, start time.Time, err *error) {
+	s3OperationDuration.WithLabelValues(operation).Observe(time.Since(start).Seconds())
+	if err != nil && *err != nil {
+		s3OperationErrors.WithLabelValues(operation).Inc()
+	}
+}
@@ -0,0 +1,257 @@
+package mounter
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/ctrox/csi-s3/pkg/config"
+	"github.com/ctrox/csi-s3/pkg/logging"
+)
+
+// The mounter daemon runs the FUSE processes of staged volumes outside of
+// the node plugin. It serves a small json api over a unix socket which is
+// only reachable from the host, so the node plugin can be restarted or
+// upgraded without interrupting I/O of mounted volumes.
+const (
+	daemonMountPath   = "/mount"
+	daemonUnmountPath = "/unmount"
+)
+
+type unmountRequest struct {
+	Path string `json:"path"`
+}
+
+// daemonMounters are the mounters whose FUSE processes the daemon runs
+var daemonMounters = []string{s3fsMounterType, rcloneMounterType, s3backerMounterType}
+
+// ServeDaemon runs the mounter daemon on the unix socket until it fails.
+// Volumes can only be mounted in directories below mountRoot.
+func ServeDaemon(socket string, mountRoot string) error {
+	socket = strings.TrimPrefix(socket, "unix://")
+	if err := os.Remove(socket); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	listener, err := net.Listen("unix", socket)
+	if err != nil {
+		return err
+	}
+	if err := os.Chmod(socket, 0600); err != nil {
+		return err
+	}
+
+	logging.InfoS("mounter daemon listening", "socket", socket)
+	return http.Serve(listener, daemonHandler(localRunner{}, mountRoot))
+}
+
+// daemonHandler serves the api of the mounter daemon running FUSE processes with r
+func daemonHandler(r fuseRunner, mountRoot string) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc(daemonMountPath, func(w http.ResponseWriter, hr *http.Request) {
+		req := &fuseRequest{}
+		if !decodeDaemonRequest(w, hr, req) {
+			return
+		}
+		if err := validateFuseRequest(req, mountRoot); err != nil {
+			logging.ErrorS(err, "mounter daemon rejected mount")
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		logging.InfoS("mounter daemon mounting", "path", req.Path, "mounter", Type(req.Meta, req.Config))
+		writeDaemonResponse(w, r.mount(req))
+	})
+	mux.HandleFunc(daemonUnmountPath, func(w http.ResponseWriter, hr *http.Request) {
+		req := &unmountRequest{}
+		if !decodeDaemonRequest(w, hr, req) {
+			return
+		}
+		if err := validateMountPath(req.Path, mountRoot); err != nil {
+			logging.ErrorS(err, "mounter daemon rejected unmount")
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		logging.InfoS("mounter daemon unmounting", "path", req.Path)
+		writeDaemonResponse(w, r.unmount(req.Path))
+	})
+	return mux
+}
+
+// validateFuseRequest returns an error unless req mounts a volume with one
+// of the mounters at a path below mountRoot. The daemon runs as root on the
+// host, so the values ending up in the command line of the mounter must
+// not be able to pass options of their own.
+func validateFuseRequest(req *fuseRequest, mountRoot string) error {
+	if req.Meta == nil || req.Config == nil {
+		return fmt.Errorf("metadata and config of the volume are required")
+	}
+	if mounterType := Type(req.Meta, req.Config); !contains(daemonMounters, mounterType) {
+		return fmt.Errorf("mounter %s is not allowed, must be one of %s", mounterType, strings.Join(daemonMounters, ", "))
+	}
+	if err := validateMountPath(req.Path, mountRoot); err != nil {
+		return err
+	}
+	for name, value := range map[string]string{
+		"bucket": req.Meta.BucketName,
+		"prefix": req.Meta.Prefix,
+		"fsPath": req.Meta.FSPath,
+		"region": req.Config.Region,
+	} {
+		if err := validateOptionValue(value); err != nil {
+			return fmt.Errorf("%s %q %s", name, value, err)
+		}
+	}
+	if req.Config.Endpoint != "" {
+		u, err := url.Parse(req.Config.Endpoint)
+		if err != nil {
+			return fmt.Errorf("invalid endpoint: %s", err)
+		}
+		if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("endpoint %q must be a http or https url", req.Config.Endpoint)
+		}
+		if err := validateOptionValue(req.Config.Endpoint); err != nil {
+			return fmt.Errorf("endpoint %q %s", req.Config.Endpoint, err)
+		}
+	}
+	switch req.Config.AddressingStyle {
+	case "", config.AddressingPath, config.AddressingVirtual:
+	default:
+		return fmt.Errorf("unknown addressing style %q", req.Config.AddressingStyle)
+	}
+	return nil
+}
+
+// validateOptionValue returns an error if value could be taken as a flag
+// or, as s3fs splits its options at commas, as an additional option
+func validateOptionValue(value string) error {
+	if strings.HasPrefix(value, "-") {
+		return fmt.Errorf("must not start with -")
+	}
+	if strings.ContainsAny(value, ",\n\x00") {
+		return fmt.Errorf("must not contain commas or control characters")
+	}
+	return nil
+}
+
+// validateMountPath returns an error unless path is a clean absolute path
+// below mountRoot which does not leave it through symlinks
+func validateMountPath(path string, mountRoot string) error {
+	if !filepath.IsAbs(path) || filepath.Clean(path) != path {
+		return fmt.Errorf("mount path %q must be a clean absolute path", path)
+	}
+	if !isBelow(path, mountRoot) {
+		return fmt.Errorf("mount path %s is not below %s", path, mountRoot)
+	}
+	// the mount point of a dead FUSE process cannot be resolved,
+	// so only its parent is resolved
+	parent, err := filepath.EvalSymlinks(filepath.Dir(path))
+	if err != nil {
+		return err
+	}
+	root, err := filepath.EvalSymlinks(mountRoot)
+	if err != nil {
+		return err
+	}
+	if parent != root && !isBelow(parent, root) {
+		return fmt.Errorf("mount path %s resolves to %s outside of %s", path, parent, mountRoot)
+	}
+	if info, err := os.Lstat(path); err == nil && info.Mode()&os.ModeSymlink != 0 {
+		return fmt.Errorf("mount path %s must not be a symlink", path)
+	}
+	return nil
+}
+
+func isBelow(path, dir string) bool {
+	return strings.HasPrefix(path, strings.TrimSuffix(dir, "/")+"/")
+}
+
+func contains(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
+func decodeDaemonRequest(w http.ResponseWriter, r *http.Request, v interface{}) bool {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return false
+	}
+	dec := json.NewDecoder(r.Body)
+	// requests of older versions passing command lines are rejected
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(v); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return false
+	}
+	return true
+}
+
+func writeDaemonResponse(w http.ResponseWriter, err error) {
+	if err != nil {
+		logging.ErrorS(err, "mounter daemon request failed")
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+// daemonClient is a fuseRunner which delegates to the mounter daemon
+type daemonClient struct {
+	client *http.Client
+}
+
+func newDaemonClient(socket string) *daemonClient {
+	socket = strings.TrimPrefix(socket, "unix://")
+	return &daemonClient{
+		client: &http.Client{
+			Transport: &http.Transport{
+				DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+					return (&net.Dialer{}).DialContext(ctx, "unix", socket)
+				},
+			},
+		},
+	}
+}
+
+func (d *daemonClient) mount(req *fuseRequest) error {
+	return d.post(daemonMountPath, req)
+}
+
+func (d *daemonClient) unmount(path string) error {
+	return d.post(daemonUnmountPath, &unmountRequest{Path: path})
+}
+
+func (d *daemonClient) post(path string, v interface{}) error {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	// mounting includes waiting for the mount to appear
+	ctx, cancel := context.WithTimeout(context.Background(), 2*config.Get().MountTimeout.Duration+config.Get().UnmountTimeout.Duration)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, "http://mounter"+path, bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to reach mounter daemon: %s", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := ioutil.ReadAll(resp.Body)
+		return fmt.Errorf("mounter daemon: %s", strings.TrimSpace(string(msg)))
+	}
+	return nil
+}
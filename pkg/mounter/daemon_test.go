@@ -0,0 +1,197 @@
+package mounter
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/ctrox/csi-s3/pkg/s3"
+)
+
+// recordingRunner records the requests of the mounter daemon
+type recordingRunner struct {
+	mounts []*fuseRequest
+}
+
+func (r *recordingRunner) mount(req *fuseRequest) error {
+	r.mounts = append(r.mounts, req)
+	return nil
+}
+
+func (r *recordingRunner) unmount(path string) error {
+	return nil
+}
+
+func newMountRoot(t *testing.T) (string, string) {
+	root, err := ioutil.TempDir("", "mountroot")
+	if err != nil {
+		t.Fatal(err)
+	}
+	staging := filepath.Join(root, "pv", "globalmount")
+	if err := os.MkdirAll(staging, 0755); err != nil {
+		t.Fatal(err)
+	}
+	return root, staging
+}
+
+func testFuseRequest(path, mounterType string) fuseRequest {
+	return fuseRequest{
+		Path:   path,
+		Meta:   &s3.FSMeta{BucketName: "bucket", Prefix: "pvc-1", FSPath: "csi-fs", Mounter: mounterType, CapacityBytes: 1024},
+		Config: &s3.Config{Endpoint: "https://s3.example.com", Region: "us-east-1", AccessKeyID: "key", SecretAccessKey: "secret"},
+	}
+}
+
+func TestValidateFuseRequest(t *testing.T) {
+	root, staging := newMountRoot(t)
+	defer os.RemoveAll(root)
+	if err := os.Symlink("/etc", filepath.Join(root, "escape")); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		name   string
+		path   string
+		modify func(req *fuseRequest)
+		valid  bool
+	}{
+		{
+			name:  "s3fs",
+			valid: true,
+		},
+		{
+			name:   "rclone",
+			modify: func(req *fuseRequest) { req.Meta.Mounter = rcloneMounterType },
+			valid:  true,
+		},
+		{
+			name:   "s3backer on aws",
+			modify: func(req *fuseRequest) { req.Meta.Mounter = s3backerMounterType; req.Config.Endpoint = "" },
+			valid:  true,
+		},
+		{
+			name:   "goofys",
+			modify: func(req *fuseRequest) { req.Meta.Mounter = goofysMounterType },
+		},
+		{
+			name:   "missing config",
+			modify: func(req *fuseRequest) { req.Config = nil },
+		},
+		{
+			name: "path outside of mount root",
+			path: "/etc",
+		},
+		{
+			name: "relative path",
+			path: filepath.Join(root, "pv", "..", "..", "etc"),
+		},
+		{
+			name: "path through symlink",
+			path: filepath.Join(root, "escape", "dir"),
+		},
+		{
+			name:   "s3fs option in endpoint",
+			modify: func(req *fuseRequest) { req.Config.Endpoint = "https://s3.example.com,passwd_file=/etc/shadow" },
+		},
+		{
+			name:   "s3fs option in region",
+			modify: func(req *fuseRequest) { req.Config.Region = "us-east-1,passwd_file=/etc/shadow" },
+		},
+		{
+			name:   "endpoint without scheme",
+			modify: func(req *fuseRequest) { req.Config.Endpoint = "/etc/shadow" },
+		},
+		{
+			name: "flag as bucket",
+			modify: func(req *fuseRequest) {
+				req.Meta.Mounter = s3backerMounterType
+				req.Meta.BucketName = "--accessFile=/etc/shadow"
+			},
+		},
+		{
+			name:   "flag as prefix",
+			modify: func(req *fuseRequest) { req.Meta.Prefix = "--config=/etc/shadow" },
+		},
+		{
+			name:   "unknown addressing style",
+			modify: func(req *fuseRequest) { req.Config.AddressingStyle = "--password-command=id" },
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			path := staging
+			if tc.path != "" {
+				path = tc.path
+			}
+			req := testFuseRequest(path, s3fsMounterType)
+			if tc.modify != nil {
+				tc.modify(&req)
+			}
+			err := validateFuseRequest(&req, root)
+			if tc.valid && err != nil {
+				t.Errorf("unexpected error: %s", err)
+			}
+			if !tc.valid && err == nil {
+				t.Error("expected request to be rejected")
+			}
+		})
+	}
+}
+
+func TestDaemonRejectsCommandLines(t *testing.T) {
+	root, staging := newMountRoot(t)
+	defer os.RemoveAll(root)
+	runner := &recordingRunner{}
+	server := httptest.NewServer(daemonHandler(runner, root))
+	defer server.Close()
+
+	for _, args := range [][]string{
+		{"mount", ":s3:bucket", staging, "--password-command=cat /etc/shadow"},
+		{"mount", ":s3:bucket", staging, "--config=/etc/shadow"},
+		{"bucket:/", staging, "-o", "passwd_file=/etc/shadow"},
+	} {
+		body, _ := json.Marshal(map[string]interface{}{"path": staging, "command": rcloneCmd, "args": args})
+		resp, err := http.Post(server.URL+daemonMountPath, "application/json", bytes.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusBadRequest {
+			t.Errorf("expected arguments %v to be rejected, got status %d", args, resp.StatusCode)
+		}
+	}
+	if len(runner.mounts) != 0 {
+		t.Fatalf("expected no mounts, got %d", len(runner.mounts))
+	}
+
+	body, _ := json.Marshal(testFuseRequest(staging, s3fsMounterType))
+	resp, err := http.Post(server.URL+daemonMountPath, "application/json", bytes.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || len(runner.mounts) != 1 {
+		t.Fatalf("expected volume to be mounted, got status %d", resp.StatusCode)
+	}
+	c, err := runner.mounts[0].command()
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if c.Command != s3fsCmd || c.Credentials != "key:secret" {
+		t.Errorf("unexpected command %+v", c)
+	}
+	if !contains(c.Args, staging) || strings.Contains(strings.Join(c.Args, " "), "passwd_file") {
+		t.Errorf("unexpected arguments %v", c.Args)
+	}
+}
+
+func TestPasswdFile(t *testing.T) {
+	if passwdFile("/a/globalmount") == passwdFile("/b/globalmount") {
+		t.Error("expected mounts to use different password files")
+	}
+}
@@ -0,0 +1,120 @@
+package mounter
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/ctrox/csi-s3/pkg/s3"
+	"k8s.io/mount-utils"
+)
+
+// FakeMounter creates Mounters for tests which record their calls and
+// mount to a fake mount.Interface instead of running FUSE processes.
+// Errors of actions can be injected with SetError.
+type FakeMounter struct {
+	mu     sync.Mutex
+	mounts mount.Interface
+	log    []FakeAction
+	errors map[string]error
+}
+
+// FakeAction is logged for every call of a fake Mounter
+type FakeAction struct {
+	// Action is stage, unstage or mount
+	Action   string
+	Source   string
+	Target   string
+	ReadOnly bool
+	Meta     *s3.FSMeta
+}
+
+// NewFakeMounter returns a FakeMounter mounting to mounts
+func NewFakeMounter(mounts mount.Interface) *FakeMounter {
+	return &FakeMounter{mounts: mounts, errors: map[string]error{}}
+}
+
+// New returns a fake Mounter of the volume described by meta,
+// it has the signature of the mounter.New factory
+func (f *FakeMounter) New(meta *s3.FSMeta, cfg *s3.Config) (Mounter, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.errors["new"]; err != nil {
+		return nil, err
+	}
+	return &fakeVolumeMounter{fake: f, meta: meta, mounterType: Type(meta, cfg)}, nil
+}
+
+// SetError makes action fail with err until it is reset with a nil err.
+// Actions are new, stage, unstage and mount.
+func (f *FakeMounter) SetError(action string, err error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err == nil {
+		delete(f.errors, action)
+		return
+	}
+	f.errors[action] = err
+}
+
+// GetLog returns the actions of all Mounters created so far
+func (f *FakeMounter) GetLog() []FakeAction {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]FakeAction{}, f.log...)
+}
+
+// ResetLog clears the log of actions
+func (f *FakeMounter) ResetLog() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.log = nil
+}
+
+func (f *FakeMounter) record(action FakeAction) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.errors[action.Action]; err != nil {
+		return err
+	}
+	f.log = append(f.log, action)
+	return nil
+}
+
+type fakeVolumeMounter struct {
+	fake        *FakeMounter
+	meta        *s3.FSMeta
+	mounterType string
+}
+
+func (m *fakeVolumeMounter) Stage(stagePath string) error {
+	source := fmt.Sprintf("%s:%s", m.mounterType, m.meta.BucketName)
+	if err := m.fake.record(FakeAction{Action: "stage", Source: source, Target: stagePath, Meta: m.meta}); err != nil {
+		return err
+	}
+	return m.fake.mounts.Mount(source, stagePath, "fuse."+m.mounterType, nil)
+}
+
+func (m *fakeVolumeMounter) Unstage(stagePath string) error {
+	if err := m.fake.record(FakeAction{Action: "unstage", Target: stagePath, Meta: m.meta}); err != nil {
+		return err
+	}
+	return m.fake.mounts.Unmount(stagePath)
+}
+
+func (m *fakeVolumeMounter) Mount(source string, target string, readOnly bool) error {
+	if err := m.fake.record(FakeAction{Action: "mount", Source: source, Target: target, ReadOnly: readOnly, Meta: m.meta}); err != nil {
+		return err
+	}
+	notMnt, err := m.fake.mounts.IsLikelyNotMountPoint(source)
+	if err != nil {
+		return err
+	}
+	if notMnt {
+		return fmt.Errorf("%s is not mounted, volume has not been staged", source)
+	}
+	options := []string{"bind"}
+	if readOnly {
+		options = append(options, "ro")
+	}
+	return m.fake.mounts.Mount(source, target, "", options)
+}
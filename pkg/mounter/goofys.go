@@ -7,14 +7,14 @@ import (
 
 	"context"
 
+	"github.com/ctrox/csi-s3/pkg/config"
 	"github.com/ctrox/csi-s3/pkg/s3"
 	goofysApi "github.com/kahing/goofys/api"
 	"github.com/kahing/goofys/api/common"
 )
 
 const (
-	goofysCmd     = "goofys"
-	defaultRegion = "us-east-1"
+	goofysCmd = "goofys"
 )
 
 // Implements Mounter
@@ -24,13 +24,23 @@ type goofysMounter struct {
 	region          string
 	accessKeyID     string
 	secretAccessKey string
+	subdomain       bool
+	ownership       *ownership
 }
 
 func newGoofysMounter(meta *s3.FSMeta, cfg *s3.Config) (Mounter, error) {
+	// goofys shares one HTTP transport between all mounts of the process
+	if cfg.InsecureSkipVerify {
+		return nil, fmt.Errorf("goofys does not support skipping TLS verification, use another mounter for profile %s", cfg.Profile)
+	}
 	region := cfg.Region
 	// if endpoint is set we need a default region
 	if region == "" && cfg.Endpoint != "" {
-		region = defaultRegion
+		region = config.Get().DefaultRegion
+	}
+	ownership, err := newOwnership(meta)
+	if err != nil {
+		return nil, err
 	}
 	return &goofysMounter{
 		meta:            meta,
@@ -38,31 +48,34 @@ func newGoofysMounter(meta *s3.FSMeta, cfg *s3.Config) (Mounter, error) {
 		region:          region,
 		accessKeyID:     cfg.AccessKeyID,
 		secretAccessKey: cfg.SecretAccessKey,
+		subdomain:       cfg.AddressingStyle == config.AddressingVirtual,
+		ownership:       ownership,
 	}, nil
 }
 
 func (goofys *goofysMounter) Stage(stageTarget string) error {
-	return nil
-}
-
-func (goofys *goofysMounter) Unstage(stageTarget string) error {
-	return nil
-}
-
-func (goofys *goofysMounter) Mount(source string, target string) error {
+	dirMode, fileMode := goofys.ownership.modes(0755, 0644)
 	goofysCfg := &common.FlagStorage{
-		MountPoint: target,
+		MountPoint: stageTarget,
 		Endpoint:   goofys.endpoint,
-		DirMode:    0755,
-		FileMode:   0644,
+		DirMode:    dirMode,
+		FileMode:   fileMode,
 		MountOptions: map[string]string{
 			"allow_other": "",
 		},
 		Backend: &common.S3Config{
-			Region: goofys.region,
+			Region:    goofys.region,
+			Subdomain: goofys.subdomain,
 		},
 	}
 
+	if goofys.ownership.uid != nil {
+		goofysCfg.Uid = *goofys.ownership.uid
+	}
+	if goofys.ownership.gid != nil {
+		goofysCfg.Gid = *goofys.ownership.gid
+	}
+
 	os.Setenv("AWS_ACCESS_KEY_ID", goofys.accessKeyID)
 	os.Setenv("AWS_SECRET_ACCESS_KEY", goofys.secretAccessKey)
 	fullPath := fmt.Sprintf("%s:%s", goofys.meta.BucketName, path.Join(goofys.meta.Prefix, goofys.meta.FSPath))
@@ -74,3 +87,11 @@ func (goofys *goofysMounter) Mount(source string, target string) error {
 	}
 	return nil
 }
+
+func (goofys *goofysMounter) Unstage(stageTarget string) error {
+	return FuseUnmount(stageTarget)
+}
+
+func (goofys *goofysMounter) Mount(source string, target string, readOnly bool) error {
+	return bindMount(source, target, readOnly)
+}
@@ -0,0 +1,152 @@
+package mounter
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/ctrox/csi-s3/pkg/logging"
+	"golang.org/x/sys/unix"
+)
+
+const (
+	loopControlDevice = "/dev/loop-control"
+	loopDevicePrefix  = "/dev/loop"
+	loopSysfsGlob     = "/sys/block/loop*/loop/backing_file"
+	// loopAttachRetries limits how often we retry when another process
+	// grabs the free loop device between allocation and attaching it
+	loopAttachRetries = 5
+)
+
+// loopMutex serializes allocation of loop devices within the driver
+var loopMutex sync.Mutex
+
+// attachLoopDevice attaches file to a free loop device and returns the path
+// of the device. If file is already attached, the existing device is returned.
+func attachLoopDevice(file string) (string, error) {
+	loopMutex.Lock()
+	defer loopMutex.Unlock()
+
+	device, err := findLoopDevice(file)
+	if err != nil {
+		return "", err
+	}
+	if device != "" {
+		logging.V(4).InfoS("file is already attached to a loop device", "file", file, "device", device)
+		return device, nil
+	}
+
+	backingFile, err := os.OpenFile(file, os.O_RDWR, 0)
+	if err != nil {
+		return "", err
+	}
+	defer backingFile.Close()
+
+	for i := 0; i < loopAttachRetries; i++ {
+		device, err = allocateLoopDevice()
+		if err != nil {
+			return "", err
+		}
+		loopFile, err := os.OpenFile(device, os.O_RDWR, 0)
+		if err != nil {
+			return "", err
+		}
+		err = unix.IoctlSetInt(int(loopFile.Fd()), unix.LOOP_SET_FD, int(backingFile.Fd()))
+		loopFile.Close()
+		if err == nil {
+			logging.InfoS("attached file to loop device", "file", file, "device", device)
+			return device, nil
+		}
+		if err != unix.EBUSY {
+			return "", fmt.Errorf("Error attaching %s to %s: %s", file, device, err)
+		}
+		logging.WarningS("loop device got busy while attaching, retrying", "device", device)
+	}
+	return "", fmt.Errorf("Unable to find a free loop device for %s", file)
+}
+
+// detachLoopDevice detaches the loop device file is attached to, if any
+func detachLoopDevice(file string) error {
+	loopMutex.Lock()
+	defer loopMutex.Unlock()
+
+	device, err := findLoopDevice(file)
+	if err != nil {
+		return err
+	}
+	if device == "" {
+		logging.V(4).InfoS("file is not attached to any loop device", "file", file)
+		return nil
+	}
+	loopFile, err := os.OpenFile(device, os.O_RDONLY, 0)
+	if err != nil {
+		return err
+	}
+	defer loopFile.Close()
+	if err := unix.IoctlSetInt(int(loopFile.Fd()), unix.LOOP_CLR_FD, 0); err != nil {
+		return fmt.Errorf("Error detaching loop device %s: %s", device, err)
+	}
+	logging.InfoS("detached loop device", "device", device, "file", file)
+	return nil
+}
+
+// findLoopDevice returns the loop device file is attached to or
+// an empty string if it is not attached.
+func findLoopDevice(file string) (string, error) {
+	backingFiles, err := filepath.Glob(loopSysfsGlob)
+	if err != nil {
+		return "", err
+	}
+	for _, backingFile := range backingFiles {
+		content, err := ioutil.ReadFile(backingFile)
+		if err != nil {
+			// the device might have been detached in the meantime
+			continue
+		}
+		if strings.TrimSpace(string(content)) == file {
+			// /sys/block/loopN/loop/backing_file
+			name := filepath.Base(filepath.Dir(filepath.Dir(backingFile)))
+			return filepath.Join("/dev", name), nil
+		}
+	}
+	return "", nil
+}
+
+// checkLoopControl checks that loop devices can be allocated
+func checkLoopControl() error {
+	control, err := openLoopControl()
+	if err != nil {
+		return err
+	}
+	return control.Close()
+}
+
+// openLoopControl opens the loop control device, creating it if needed
+func openLoopControl() (*os.File, error) {
+	if err := createDevice(loopControlDevice, "c", 10, 237); err != nil {
+		return nil, err
+	}
+	return os.OpenFile(loopControlDevice, os.O_RDWR, 0)
+}
+
+// allocateLoopDevice asks the kernel for a free loop device
+// and ensures its device node exists.
+func allocateLoopDevice() (string, error) {
+	control, err := openLoopControl()
+	if err != nil {
+		return "", err
+	}
+	defer control.Close()
+	index, err := unix.IoctlRetInt(int(control.Fd()), unix.LOOP_CTL_GET_FREE)
+	if err != nil {
+		return "", fmt.Errorf("Error getting free loop device: %s", err)
+	}
+	device := fmt.Sprintf("%s%d", loopDevicePrefix, index)
+	if err := createDevice(device, "b", 7, index); err != nil {
+		return "", err
+	}
+	return device, nil
+}
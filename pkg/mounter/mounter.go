@@ -10,8 +10,9 @@ import (
 	"syscall"
 	"time"
 
+	"github.com/ctrox/csi-s3/pkg/config"
+	"github.com/ctrox/csi-s3/pkg/logging"
 	"github.com/ctrox/csi-s3/pkg/s3"
-	"github.com/golang/glog"
 	"github.com/mitchellh/go-ps"
 	"k8s.io/mount-utils"
 )
@@ -21,7 +22,7 @@ import (
 type Mounter interface {
 	Stage(stagePath string) error
 	Unstage(stagePath string) error
-	Mount(source string, target string) error
+	Mount(source string, target string, readOnly bool) error
 }
 
 const (
@@ -33,16 +34,48 @@ const (
 	BucketKey           = "bucket"
 	VolumePrefix        = "prefix"
 	UsePrefix           = "usePrefix"
+	FsTypeKey           = "fsType"
+	MkfsOptionsKey      = "mkfsOptions"
 )
 
-// New returns a new mounter depending on the mounterType parameter
-func New(meta *s3.FSMeta, cfg *s3.Config) (Mounter, error) {
+// IsSupported returns true if mounterType is a known mounter
+func IsSupported(mounterType string) bool {
+	switch mounterType {
+	case s3fsMounterType, goofysMounterType, s3backerMounterType, rcloneMounterType:
+		return true
+	}
+	return false
+}
+
+// RunsInProcess returns true if the mounter serves its mounts from within
+// the driver process, so they stop working when the driver exits
+func RunsInProcess(mounterType string) bool {
+	return mounterType == goofysMounterType
+}
+
+// SupportsEphemeral returns true if the mounter can mount an existing
+// bucket without a filesystem created by the controller
+func SupportsEphemeral(mounterType string) bool {
+	return mounterType != s3backerMounterType
+}
+
+// Type returns the type of mounter used for the volume described by meta
+func Type(meta *s3.FSMeta, cfg *s3.Config) string {
 	mounter := meta.Mounter
 	// Fall back to mounterType in cfg
 	if len(meta.Mounter) == 0 {
 		mounter = cfg.Mounter
 	}
-	switch mounter {
+	if IsSupported(mounter) {
+		return mounter
+	}
+	// default to s3backer
+	return s3backerMounterType
+}
+
+// New returns a new mounter depending on the mounterType parameter
+func New(meta *s3.FSMeta, cfg *s3.Config) (Mounter, error) {
+	switch Type(meta, cfg) {
 	case s3fsMounterType:
 		return newS3fsMounter(meta, cfg)
 
@@ -56,22 +89,65 @@ func New(meta *s3.FSMeta, cfg *s3.Config) (Mounter, error) {
 		return newRcloneMounter(meta, cfg)
 
 	default:
-		// default to s3backer
 		return newS3backerMounter(meta, cfg)
 	}
 }
 
-func fuseMount(path string, command string, args []string) error {
-	cmd := exec.Command(command, args...)
-	glog.V(3).Infof("Mounting fuse with command: %s and args: %s", command, args)
-	cmd.Stdout = os.Stdout
-	cmd.Stderr = os.Stderr
-
-	if err := cmd.Run(); err != nil {
-		return fmt.Errorf("Error fuseMount command: %s\nargs: %s\noutput", command, args)
+// Check returns the version of the mounter if it is usable on this node
+func Check(mounterType string) (string, error) {
+	var cmd *exec.Cmd
+	switch mounterType {
+	case s3fsMounterType:
+		cmd = exec.Command(s3fsCmd, "--version")
+	case rcloneMounterType:
+		cmd = exec.Command(rcloneCmd, "version")
+	case s3backerMounterType:
+		if err := checkLoopControl(); err != nil {
+			return "", fmt.Errorf("loop devices are not available: %s", err)
+		}
+		cmd = exec.Command(s3backerCmd, "--version")
+	case goofysMounterType:
+		// goofys runs within the driver
+		return "built-in", nil
+	default:
+		return "", fmt.Errorf("unknown mounter %s", mounterType)
 	}
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		return "", fmt.Errorf("failed to run %s: %s", cmd.Path, err)
+	}
+	return strings.TrimSpace(strings.SplitN(string(out), "\n", 2)[0]), nil
+}
 
-	return waitForMount(path, 10*time.Second)
+// fuseMount starts the FUSE process of the volume described by
+// meta and cfg serving path
+func fuseMount(path string, meta *s3.FSMeta, cfg *s3.Config) error {
+	return runner.mount(&fuseRequest{
+		Path:   path,
+		Meta:   meta,
+		Config: cfg,
+	})
+}
+
+// fuseUnmount unmounts a mount started with fuseMount
+func fuseUnmount(path string) error {
+	return runner.unmount(path)
+}
+
+// bindMount bind mounts the staged volume at source to target
+func bindMount(source string, target string, readOnly bool) error {
+	notMnt, err := mount.New("").IsLikelyNotMountPoint(source)
+	if err != nil {
+		return err
+	}
+	if notMnt {
+		return fmt.Errorf("%s is not mounted, volume has not been staged", source)
+	}
+	options := []string{"bind"}
+	if readOnly {
+		options = append(options, "ro")
+	}
+	return mount.New("").Mount(source, target, "", options)
 }
 
 func FuseUnmount(path string) error {
@@ -81,15 +157,15 @@ func FuseUnmount(path string) error {
 	// as fuse quits immediately, we will try to wait until the process is done
 	process, err := findFuseMountProcess(path)
 	if err != nil {
-		glog.Errorf("Error getting PID of fuse mount: %s", err)
+		logging.ErrorS(err, "failed to get PID of fuse mount", "path", path)
 		return nil
 	}
 	if process == nil {
-		glog.Warningf("Unable to find PID of fuse mount %s, it must have finished already", path)
+		logging.WarningS("unable to find PID of fuse mount, it must have finished already", "path", path)
 		return nil
 	}
-	glog.Infof("Found fuse pid %v of mount %s, checking if it still runs", process.Pid, path)
-	return waitForProcess(process, 1)
+	logging.InfoS("found fuse process of mount, checking if it still runs", "pid", process.Pid, "path", path)
+	return waitForProcess(process, 1, time.Now().Add(config.Get().UnmountTimeout.Duration))
 }
 
 func waitForMount(path string, timeout time.Duration) error {
@@ -119,40 +195,40 @@ func findFuseMountProcess(path string) (*os.Process, error) {
 	for _, p := range processes {
 		cmdLine, err := getCmdLine(p.Pid())
 		if err != nil {
-			glog.Errorf("Unable to get cmdline of PID %v: %s", p.Pid(), err)
+			logging.ErrorS(err, "unable to get cmdline of process", "pid", p.Pid())
 			continue
 		}
 		if strings.Contains(cmdLine, path) {
-			glog.Infof("Found matching pid %v on path %s", p.Pid(), path)
+			logging.InfoS("found matching process of mount", "pid", p.Pid(), "path", path)
 			return os.FindProcess(p.Pid())
 		}
 	}
 	return nil, nil
 }
 
-func waitForProcess(p *os.Process, backoff int) error {
-	if backoff == 20 {
+func waitForProcess(p *os.Process, backoff int, deadline time.Time) error {
+	if time.Now().After(deadline) {
 		return fmt.Errorf("Timeout waiting for PID %v to end", p.Pid)
 	}
 	cmdLine, err := getCmdLine(p.Pid)
 	if err != nil {
-		glog.Warningf("Error checking cmdline of PID %v, assuming it is dead: %s", p.Pid, err)
+		logging.WarningS("failed to check cmdline of process, assuming it is dead", "pid", p.Pid, "err", err)
 		return nil
 	}
 	if cmdLine == "" {
 		// ignore defunct processes
 		// TODO: debug why this happens in the first place
 		// seems to only happen on k8s, not on local docker
-		glog.Warning("Fuse process seems dead, returning")
+		logging.WarningS("fuse process seems dead, returning", "pid", p.Pid)
 		return nil
 	}
 	if err := p.Signal(syscall.Signal(0)); err != nil {
-		glog.Warningf("Fuse process does not seem active or we are unprivileged: %s", err)
+		logging.WarningS("fuse process does not seem active or we are unprivileged", "pid", p.Pid, "err", err)
 		return nil
 	}
-	glog.Infof("Fuse process with PID %v still active, waiting...", p.Pid)
+	logging.InfoS("fuse process still active, waiting", "pid", p.Pid)
 	time.Sleep(time.Duration(backoff*100) * time.Millisecond)
-	return waitForProcess(p, backoff+1)
+	return waitForProcess(p, backoff+1, deadline)
 }
 
 func getCmdLine(pid int) (string, error) {
@@ -164,19 +240,20 @@ func getCmdLine(pid int) (string, error) {
 	return string(cmdLine), nil
 }
 
-func createLoopDevice(device string) error {
+// createDevice creates the device node if it does not exist yet
+func createDevice(device string, deviceType string, major int, minor int) error {
 	if _, err := os.Stat(device); !os.IsNotExist(err) {
 		return nil
 	}
 	args := []string{
 		device,
-		"b", "7", "0",
+		deviceType, fmt.Sprint(major), fmt.Sprint(minor),
 	}
 	cmd := exec.Command("mknod", args...)
 
 	out, err := cmd.CombinedOutput()
 	if err != nil {
-		return fmt.Errorf("Error configuring loop device: %s", out)
+		return fmt.Errorf("Error creating device %s: %s", device, out)
 	}
 	return nil
 }
@@ -0,0 +1,115 @@
+package mounter
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+
+	"github.com/ctrox/csi-s3/pkg/s3"
+)
+
+const (
+	UIDKey      = "uid"
+	GIDKey      = "gid"
+	UmaskKey    = "umask"
+	DirModeKey  = "dirMode"
+	FileModeKey = "fileMode"
+
+	// mountGroupUmask is applied if a volume mount group is requested
+	// without explicit modes, so the group is allowed to write
+	mountGroupUmask = "0002"
+)
+
+// ownership holds the uid, gid and modes object mounters
+// should present files with. Nil values are not set.
+type ownership struct {
+	uid      *uint32
+	gid      *uint32
+	umask    *os.FileMode
+	dirMode  *os.FileMode
+	fileMode *os.FileMode
+}
+
+// ValidateOwnership returns an error if the ownership settings of meta are invalid
+func ValidateOwnership(meta *s3.FSMeta) error {
+	_, err := newOwnership(meta)
+	return err
+}
+
+// SetMountGroup makes the volume owned by the group gid as requested
+// by the volume mount group (fsGroup) of a volume capability
+func SetMountGroup(meta *s3.FSMeta, gid string) {
+	if gid == "" {
+		return
+	}
+	meta.GID = gid
+	if meta.Umask == "" && meta.DirMode == "" && meta.FileMode == "" {
+		meta.Umask = mountGroupUmask
+	}
+}
+
+func newOwnership(meta *s3.FSMeta) (*ownership, error) {
+	var err error
+	o := &ownership{}
+	if o.uid, err = parseID(UIDKey, meta.UID); err != nil {
+		return nil, err
+	}
+	if o.gid, err = parseID(GIDKey, meta.GID); err != nil {
+		return nil, err
+	}
+	if o.umask, err = parseMode(UmaskKey, meta.Umask); err != nil {
+		return nil, err
+	}
+	if o.dirMode, err = parseMode(DirModeKey, meta.DirMode); err != nil {
+		return nil, err
+	}
+	if o.fileMode, err = parseMode(FileModeKey, meta.FileMode); err != nil {
+		return nil, err
+	}
+	return o, nil
+}
+
+// modes returns the directory and file modes, explicit modes take precedence
+// over the umask which in turn takes precedence over the passed defaults
+func (o *ownership) modes(defaultDirMode, defaultFileMode os.FileMode) (os.FileMode, os.FileMode) {
+	dirMode, fileMode := defaultDirMode, defaultFileMode
+	if o.umask != nil {
+		dirMode = 0777 &^ *o.umask
+		fileMode = 0666 &^ *o.umask
+	}
+	if o.dirMode != nil {
+		dirMode = *o.dirMode
+	}
+	if o.fileMode != nil {
+		fileMode = *o.fileMode
+	}
+	return dirMode, fileMode
+}
+
+func (o *ownership) isModeSet() bool {
+	return o.umask != nil || o.dirMode != nil || o.fileMode != nil
+}
+
+func parseID(key string, value string) (*uint32, error) {
+	if value == "" {
+		return nil, nil
+	}
+	id, err := strconv.ParseUint(value, 10, 32)
+	if err != nil {
+		return nil, fmt.Errorf("invalid %s %q: %s", key, value, err)
+	}
+	id32 := uint32(id)
+	return &id32, nil
+}
+
+func parseMode(key string, value string) (*os.FileMode, error) {
+	if value == "" {
+		return nil, nil
+	}
+	mode, err := strconv.ParseUint(value, 8, 32)
+	if err != nil || mode > 0777 {
+		return nil, fmt.Errorf("invalid %s %q: must be an octal permission like 0755", key, value)
+	}
+	fileMode := os.FileMode(mode)
+	return &fileMode, nil
+}
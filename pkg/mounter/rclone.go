@@ -2,19 +2,23 @@ package mounter
 
 import (
 	"fmt"
-	"os"
 	"path"
 
+	"github.com/ctrox/csi-s3/pkg/config"
 	"github.com/ctrox/csi-s3/pkg/s3"
 )
 
 // Implements Mounter
 type rcloneMounter struct {
 	meta            *s3.FSMeta
+	cfg             *s3.Config
 	url             string
 	region          string
 	accessKeyID     string
 	secretAccessKey string
+	insecure        bool
+	addressingStyle string
+	ownership       *ownership
 }
 
 const (
@@ -22,28 +26,32 @@ const (
 )
 
 func newRcloneMounter(meta *s3.FSMeta, cfg *s3.Config) (Mounter, error) {
+	ownership, err := newOwnership(meta)
+	if err != nil {
+		return nil, err
+	}
 	return &rcloneMounter{
 		meta:            meta,
+		cfg:             cfg,
 		url:             cfg.Endpoint,
 		region:          cfg.Region,
 		accessKeyID:     cfg.AccessKeyID,
 		secretAccessKey: cfg.SecretAccessKey,
+		insecure:        cfg.InsecureSkipVerify,
+		addressingStyle: cfg.AddressingStyle,
+		ownership:       ownership,
 	}, nil
 }
 
 func (rclone *rcloneMounter) Stage(stageTarget string) error {
-	return nil
-}
-
-func (rclone *rcloneMounter) Unstage(stageTarget string) error {
-	return nil
+	return fuseMount(stageTarget, rclone.meta, rclone.cfg)
 }
 
-func (rclone *rcloneMounter) Mount(source string, target string) error {
+func (rclone *rcloneMounter) command(stageTarget string) *fuseCommand {
 	args := []string{
 		"mount",
 		fmt.Sprintf(":s3:%s", path.Join(rclone.meta.BucketName, rclone.meta.Prefix, rclone.meta.FSPath)),
-		fmt.Sprintf("%s", target),
+		fmt.Sprintf("%s", stageTarget),
 		"--daemon",
 		"--s3-provider=AWS",
 		"--s3-env-auth=true",
@@ -53,7 +61,39 @@ func (rclone *rcloneMounter) Mount(source string, target string) error {
 		// TODO: make this configurable
 		"--vfs-cache-mode=writes",
 	}
-	os.Setenv("AWS_ACCESS_KEY_ID", rclone.accessKeyID)
-	os.Setenv("AWS_SECRET_ACCESS_KEY", rclone.secretAccessKey)
-	return fuseMount(target, rcloneCmd, args)
+	switch rclone.addressingStyle {
+	case config.AddressingPath:
+		args = append(args, "--s3-force-path-style=true")
+	case config.AddressingVirtual:
+		args = append(args, "--s3-force-path-style=false")
+	}
+	if rclone.insecure {
+		args = append(args, "--no-check-certificate")
+	}
+	if cacheDir := config.Get().CacheDir; cacheDir != "" {
+		args = append(args, fmt.Sprintf("--cache-dir=%s", path.Join(cacheDir, rcloneCmd, rclone.meta.BucketName, rclone.meta.Prefix)))
+	}
+	if rclone.ownership.uid != nil {
+		args = append(args, fmt.Sprintf("--uid=%d", *rclone.ownership.uid))
+	}
+	if rclone.ownership.gid != nil {
+		args = append(args, fmt.Sprintf("--gid=%d", *rclone.ownership.gid))
+	}
+	if rclone.ownership.isModeSet() {
+		dirMode, fileMode := rclone.ownership.modes(0777, 0666)
+		args = append(args, fmt.Sprintf("--dir-perms=%04o", dirMode), fmt.Sprintf("--file-perms=%04o", fileMode))
+	}
+	env := []string{
+		"AWS_ACCESS_KEY_ID=" + rclone.accessKeyID,
+		"AWS_SECRET_ACCESS_KEY=" + rclone.secretAccessKey,
+	}
+	return &fuseCommand{Command: rcloneCmd, Args: args, Env: env}
+}
+
+func (rclone *rcloneMounter) Unstage(stageTarget string) error {
+	return fuseUnmount(stageTarget)
+}
+
+func (rclone *rcloneMounter) Mount(source string, target string, readOnly bool) error {
+	return bindMount(source, target, readOnly)
 }
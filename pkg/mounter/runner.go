@@ -0,0 +1,145 @@
+package mounter
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+
+	"github.com/ctrox/csi-s3/pkg/config"
+	"github.com/ctrox/csi-s3/pkg/logging"
+	"github.com/ctrox/csi-s3/pkg/s3"
+)
+
+// fuseRequest describes the FUSE process of the volume described by Meta
+// and Config serving a mount at Path. The command line is built by the
+// mounter of the volume in the process running it, so the mounter daemon
+// never runs arbitrary arguments.
+type fuseRequest struct {
+	Path   string     `json:"path"`
+	Meta   *s3.FSMeta `json:"meta"`
+	Config *s3.Config `json:"config"`
+}
+
+// fuseCommand is the command line of a FUSE process
+type fuseCommand struct {
+	Command string
+	Args    []string
+	// Env is added to the environment of the process
+	Env []string
+	// Credentials are written to a password file of the mount before the
+	// process starts, which is passed with the option of Command
+	Credentials string
+}
+
+// fuseMounter is a Mounter whose mounts are served by a FUSE process
+type fuseMounter interface {
+	Mounter
+	// command returns the command line of the FUSE process serving path
+	command(path string) *fuseCommand
+}
+
+// command returns the command line of the FUSE process of req
+func (req *fuseRequest) command() (*fuseCommand, error) {
+	if req.Meta == nil || req.Config == nil {
+		return nil, fmt.Errorf("metadata and config of the volume are required")
+	}
+	m, err := New(req.Meta, req.Config)
+	if err != nil {
+		return nil, err
+	}
+	fm, ok := m.(fuseMounter)
+	if !ok {
+		return nil, fmt.Errorf("mounter %s does not run a FUSE process", Type(req.Meta, req.Config))
+	}
+	return fm.command(req.Path), nil
+}
+
+// fuseRunner runs and stops the FUSE processes of staged mounts
+type fuseRunner interface {
+	mount(req *fuseRequest) error
+	unmount(path string) error
+}
+
+// passwdDir is the directory within the home directory
+// the password files of the mounts are written to
+const passwdDir = ".csi-s3"
+
+// runner runs FUSE processes as children of the driver by default
+var runner fuseRunner = localRunner{}
+
+// UseDaemon runs FUSE processes in the mounter daemon listening on socket
+// instead of the driver, so they survive restarts of the driver
+func UseDaemon(socket string) {
+	runner = newDaemonClient(socket)
+}
+
+// localRunner runs FUSE processes as children of the current process
+type localRunner struct{}
+
+func (localRunner) mount(req *fuseRequest) error {
+	c, err := req.command()
+	if err != nil {
+		return err
+	}
+	args := c.Args
+	if c.Credentials != "" {
+		option, ok := passwdFileOptions[c.Command]
+		if !ok {
+			return fmt.Errorf("%s does not read credentials from a file", c.Command)
+		}
+		file, err := writePasswdFile(req.Path, c.Credentials)
+		if err != nil {
+			return err
+		}
+		args = append(append([]string{}, args...), option(file)...)
+	}
+	cmd := exec.Command(c.Command, args...)
+	logging.V(3).InfoS("Mounting fuse", "command", c.Command, "args", logging.MaskArgs(args))
+	cmd.Env = append(os.Environ(), c.Env...)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("Error fuseMount command: %s\nargs: %s\nerror: %s", c.Command, logging.MaskArgs(args), err)
+	}
+
+	return waitForMount(req.Path, config.Get().MountTimeout.Duration)
+}
+
+func (localRunner) unmount(path string) error {
+	if err := FuseUnmount(path); err != nil {
+		return err
+	}
+	if err := os.Remove(passwdFile(path)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// passwdFileOptions are the options passing a password file to the mounters
+var passwdFileOptions = map[string]func(file string) []string{
+	s3fsCmd:     func(file string) []string { return []string{"-o", "passwd_file=" + file} },
+	s3backerCmd: func(file string) []string { return []string{"--accessFile=" + file} },
+}
+
+// passwdFile returns the password file of the mount at path. Every mount
+// has its own so mounts with different credentials can be staged concurrently.
+func passwdFile(path string) string {
+	return filepath.Join(os.Getenv("HOME"), passwdDir, fmt.Sprintf("%x", sha256.Sum256([]byte(path))))
+}
+
+// writePasswdFile writes the credentials of the mount at path to its
+// password file, only accessible by the current user
+func writePasswdFile(path, credentials string) (string, error) {
+	file := passwdFile(path)
+	if err := os.MkdirAll(filepath.Dir(file), 0700); err != nil {
+		return "", err
+	}
+	if err := ioutil.WriteFile(file, []byte(credentials), 0600); err != nil {
+		return "", err
+	}
+	return file, nil
+}
@@ -8,8 +8,9 @@ import (
 
 	osexec "os/exec"
 
+	"github.com/ctrox/csi-s3/pkg/config"
+	"github.com/ctrox/csi-s3/pkg/logging"
 	"github.com/ctrox/csi-s3/pkg/s3"
-	"github.com/golang/glog"
 	"k8s.io/mount-utils"
 	"k8s.io/utils/exec"
 )
@@ -17,24 +18,42 @@ import (
 // Implements Mounter
 type s3backerMounter struct {
 	meta            *s3.FSMeta
+	cfg             *s3.Config
 	url             string
 	region          string
 	accessKeyID     string
 	secretAccessKey string
 	ssl             bool
+	insecure        bool
+	vhost           bool
+	ownership       *ownership
 }
 
 const (
-	s3backerCmd    = "s3backer"
-	s3backerFsType = "xfs"
-	s3backerDevice = "file"
+	s3backerCmd           = "s3backer"
+	s3backerDefaultFsType = "xfs"
+	s3backerDevice        = "file"
 	// blockSize to use in k
-	s3backerBlockSize   = "128k"
-	s3backerDefaultSize = 1024 * 1024 * 1024 // 1GiB
-	// S3backerLoopDevice the loop device required by s3backer
-	S3backerLoopDevice = "/dev/loop0"
+	s3backerBlockSize = "128k"
 )
 
+// s3backerFsTypes are the filesystems s3backer volumes can be formatted with
+var s3backerFsTypes = []string{"xfs", "ext4", "btrfs"}
+
+// IsSupportedFsType returns true if volumes can be formatted with fsType.
+// An empty fsType selects the default filesystem.
+func IsSupportedFsType(fsType string) bool {
+	if fsType == "" {
+		return true
+	}
+	for _, t := range s3backerFsTypes {
+		if t == fsType {
+			return true
+		}
+	}
+	return false
+}
+
 func newS3backerMounter(meta *s3.FSMeta, cfg *s3.Config) (Mounter, error) {
 	url, err := url.Parse(cfg.Endpoint)
 	if err != nil {
@@ -43,18 +62,26 @@ func newS3backerMounter(meta *s3.FSMeta, cfg *s3.Config) (Mounter, error) {
 	url.Path = path.Join(url.Path, meta.BucketName, meta.Prefix, meta.FSPath)
 	// s3backer cannot work with 0 size volumes
 	if meta.CapacityBytes == 0 {
-		meta.CapacityBytes = s3backerDefaultSize
+		meta.CapacityBytes = config.Get().S3backerDefaultSize
+	}
+	ownership, err := newOwnership(meta)
+	if err != nil {
+		return nil, err
 	}
 	s3backer := &s3backerMounter{
 		meta:            meta,
+		cfg:             cfg,
 		url:             cfg.Endpoint,
 		region:          cfg.Region,
 		accessKeyID:     cfg.AccessKeyID,
 		secretAccessKey: cfg.SecretAccessKey,
 		ssl:             url.Scheme == "https",
+		insecure:        cfg.InsecureSkipVerify,
+		vhost:           cfg.AddressingStyle == config.AddressingVirtual,
+		ownership:       ownership,
 	}
 
-	return s3backer, s3backer.writePasswd()
+	return s3backer, nil
 }
 
 func (s3backer *s3backerMounter) String() string {
@@ -62,41 +89,115 @@ func (s3backer *s3backerMounter) String() string {
 }
 
 func (s3backer *s3backerMounter) Stage(stageTarget string) error {
-	// s3backer uses the loop device
-	if err := createLoopDevice(S3backerLoopDevice); err != nil {
-		return err
-	}
 	// s3backer requires two mounts
 	// first mount will fuse mount the bucket to a single 'file'
 	if err := s3backer.mountInit(stageTarget); err != nil {
 		return err
 	}
-	// ensure 'file' device is formatted
-	err := formatFs(s3backerFsType, path.Join(stageTarget, s3backerDevice))
+	// the 'file' is attached to its own loop device so
+	// multiple volumes can be staged on the same node
+	device, err := attachLoopDevice(path.Join(stageTarget, s3backerDevice))
 	if err != nil {
-		FuseUnmount(stageTarget)
+		fuseUnmount(stageTarget)
+		return err
+	}
+	// ensure loop device is formatted
+	err = formatFs(s3backer.fsType(), device, s3backer.meta.MkfsOptions)
+	if err != nil {
+		detachLoopDevice(path.Join(stageTarget, s3backerDevice))
+		fuseUnmount(stageTarget)
 	}
 	return err
 }
 
 func (s3backer *s3backerMounter) Unstage(stageTarget string) error {
+	if err := detachLoopDevice(path.Join(stageTarget, s3backerDevice)); err != nil {
+		return err
+	}
 	// Unmount the s3backer fuse mount
-	return FuseUnmount(stageTarget)
+	return fuseUnmount(stageTarget)
 }
 
-func (s3backer *s3backerMounter) Mount(source string, target string) error {
-	device := path.Join(source, s3backerDevice)
-	// second mount will mount the 'file' as a filesystem
-	err := mount.New("").Mount(device, target, s3backerFsType, []string{})
+func (s3backer *s3backerMounter) Mount(source string, target string, readOnly bool) error {
+	device, err := findLoopDevice(path.Join(source, s3backerDevice))
+	if err != nil {
+		return err
+	}
+	if device == "" {
+		return fmt.Errorf("s3backer device of %s is not attached to a loop device, volume is not staged", source)
+	}
+	// existing volumes keep mounting with the type they were formatted with
+	fsType, err := getDiskFormat(device)
+	if err != nil {
+		return err
+	}
+	if fsType == "" {
+		fsType = s3backer.fsType()
+	}
+	options := []string{}
+	if readOnly {
+		options = append(options, "ro")
+	}
+	// second mount will mount the loop device as a filesystem
+	err = mount.New("").Mount(device, target, fsType, options)
 	if err != nil {
-		// cleanup fuse mount
-		FuseUnmount(target)
+		// cleanup loop device and fuse mount of the staged volume
+		detachLoopDevice(path.Join(source, s3backerDevice))
+		fuseUnmount(source)
 		return err
 	}
+	if !readOnly {
+		if err := s3backer.applyOwnership(target); err != nil {
+			mount.New("").Unmount(target)
+			return fmt.Errorf("failed to apply ownership to %s: %s", target, err)
+		}
+	}
 	return nil
 }
 
+// applyOwnership sets the owner and mode of the root of the filesystem.
+// Files of s3backer volumes keep the owner they are created with, so
+// like kubelet does for fsGroup only the root is changed and its setgid
+// bit makes new files inherit the group.
+func (s3backer *s3backerMounter) applyOwnership(root string) error {
+	o := s3backer.ownership
+	if o.uid == nil && o.gid == nil && !o.isModeSet() {
+		return nil
+	}
+	uid, gid := -1, -1
+	if o.uid != nil {
+		uid = int(*o.uid)
+	}
+	if o.gid != nil {
+		gid = int(*o.gid)
+	}
+	if err := os.Chown(root, uid, gid); err != nil {
+		return err
+	}
+	info, err := os.Stat(root)
+	if err != nil {
+		return err
+	}
+	// a volume mount group comes with a group writable umask
+	mode, _ := o.modes(info.Mode().Perm(), 0)
+	if o.gid != nil {
+		mode |= os.ModeSetgid
+	}
+	return os.Chmod(root, mode)
+}
+
+func (s3backer *s3backerMounter) fsType() string {
+	if s3backer.meta.FSType != "" {
+		return s3backer.meta.FSType
+	}
+	return s3backerDefaultFsType
+}
+
 func (s3backer *s3backerMounter) mountInit(p string) error {
+	return fuseMount(p, s3backer.meta, s3backer.cfg)
+}
+
+func (s3backer *s3backerMounter) command(p string) *fuseCommand {
 	args := []string{
 		fmt.Sprintf("--blockSize=%s", s3backerBlockSize),
 		fmt.Sprintf("--size=%v", s3backer.meta.CapacityBytes),
@@ -115,43 +216,40 @@ func (s3backer *s3backerMounter) mountInit(p string) error {
 	if s3backer.ssl {
 		args = append(args, "--ssl")
 	}
-
-	return fuseMount(p, s3backerCmd, args)
-}
-
-func (s3backer *s3backerMounter) writePasswd() error {
-	pwFileName := fmt.Sprintf("%s/.s3backer_passwd", os.Getenv("HOME"))
-	pwFile, err := os.OpenFile(pwFileName, os.O_RDWR|os.O_CREATE, 0600)
-	if err != nil {
-		return err
+	if s3backer.insecure {
+		args = append(args, "--insecure")
 	}
-	_, err = pwFile.WriteString(s3backer.accessKeyID + ":" + s3backer.secretAccessKey)
-	if err != nil {
-		return err
+	if s3backer.vhost {
+		args = append(args, "--vhost")
 	}
-	pwFile.Close()
-	return nil
+
+	return &fuseCommand{Command: s3backerCmd, Args: args, Credentials: s3backer.accessKeyID + ":" + s3backer.secretAccessKey}
 }
 
-func formatFs(fsType string, device string) error {
+func getDiskFormat(device string) (string, error) {
 	diskMounter := &mount.SafeFormatAndMount{Interface: mount.New(""), Exec: exec.New()}
-	format, err := diskMounter.GetDiskFormat(device)
+	return diskMounter.GetDiskFormat(device)
+}
+
+func formatFs(fsType string, device string, options []string) error {
+	format, err := getDiskFormat(device)
 	if err != nil {
 		return err
 	}
 	if format != "" {
-		glog.Infof("Disk %s is already formatted with format %s", device, format)
+		if format != fsType {
+			logging.WarningS("disk is formatted with another filesystem than requested, keeping existing format", "device", device, "format", format, "fsType", fsType)
+		}
+		logging.InfoS("disk is already formatted", "device", device, "format", format)
 		return nil
 	}
-	args := []string{
-		device,
-	}
+	args := append(append([]string{}, options...), device)
 	cmd := osexec.Command("mkfs."+fsType, args...)
 
 	out, err := cmd.CombinedOutput()
 	if err != nil {
 		return fmt.Errorf("Error formatting disk: %s", out)
 	}
-	glog.Infof("Formatting fs with type %s", fsType)
+	logging.InfoS("formatting disk", "device", device, "fsType", fsType)
 	return nil
 }
@@ -0,0 +1,44 @@
+package mounter
+
+import (
+	"io/ioutil"
+	"os"
+	"syscall"
+	"testing"
+
+	"github.com/ctrox/csi-s3/pkg/s3"
+)
+
+func TestS3backerApplyOwnership(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("changing the owner requires root")
+	}
+	root, err := ioutil.TempDir("", "s3backer")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+	if err := os.Chmod(root, 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	meta := &s3.FSMeta{BucketName: "bucket", CapacityBytes: 1 << 20}
+	SetMountGroup(meta, "2000")
+	m, err := newS3backerMounter(meta, &s3.Config{Endpoint: "http://localhost:9000"})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if err := m.(*s3backerMounter).applyOwnership(root); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	info, err := os.Stat(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if gid := info.Sys().(*syscall.Stat_t).Gid; gid != 2000 {
+		t.Errorf("expected group 2000, got %d", gid)
+	}
+	if mode := info.Mode() & (os.ModePerm | os.ModeSetgid); mode != 0775|os.ModeSetgid {
+		t.Errorf("expected group writable setgid root, got %s", mode)
+	}
+}
@@ -2,18 +2,22 @@ package mounter
 
 import (
 	"fmt"
-	"os"
 	"path"
 
+	"github.com/ctrox/csi-s3/pkg/config"
 	"github.com/ctrox/csi-s3/pkg/s3"
 )
 
 // Implements Mounter
 type s3fsMounter struct {
 	meta          *s3.FSMeta
+	cfg           *s3.Config
 	url           string
 	region        string
 	pwFileContent string
+	insecure      bool
+	virtualHost   bool
+	ownership     *ownership
 }
 
 const (
@@ -21,48 +25,63 @@ const (
 )
 
 func newS3fsMounter(meta *s3.FSMeta, cfg *s3.Config) (Mounter, error) {
+	ownership, err := newOwnership(meta)
+	if err != nil {
+		return nil, err
+	}
 	return &s3fsMounter{
 		meta:          meta,
+		cfg:           cfg,
 		url:           cfg.Endpoint,
 		region:        cfg.Region,
 		pwFileContent: cfg.AccessKeyID + ":" + cfg.SecretAccessKey,
+		insecure:      cfg.InsecureSkipVerify,
+		virtualHost:   cfg.AddressingStyle == config.AddressingVirtual,
+		ownership:     ownership,
 	}, nil
 }
 
 func (s3fs *s3fsMounter) Stage(stageTarget string) error {
-	return nil
-}
-
-func (s3fs *s3fsMounter) Unstage(stageTarget string) error {
-	return nil
+	return fuseMount(stageTarget, s3fs.meta, s3fs.cfg)
 }
 
-func (s3fs *s3fsMounter) Mount(source string, target string) error {
-	if err := writes3fsPass(s3fs.pwFileContent); err != nil {
-		return err
-	}
+func (s3fs *s3fsMounter) command(stageTarget string) *fuseCommand {
 	args := []string{
 		fmt.Sprintf("%s:/%s", s3fs.meta.BucketName, path.Join(s3fs.meta.Prefix, s3fs.meta.FSPath)),
-		target,
-		"-o", "use_path_request_style",
+		stageTarget,
 		"-o", fmt.Sprintf("url=%s", s3fs.url),
 		"-o", fmt.Sprintf("endpoint=%s", s3fs.region),
 		"-o", "allow_other",
 		"-o", "mp_umask=000",
 	}
-	return fuseMount(target, s3fsCmd, args)
-}
-
-func writes3fsPass(pwFileContent string) error {
-	pwFileName := fmt.Sprintf("%s/.passwd-s3fs", os.Getenv("HOME"))
-	pwFile, err := os.OpenFile(pwFileName, os.O_RDWR|os.O_CREATE, 0600)
-	if err != nil {
-		return err
+	if !s3fs.virtualHost {
+		args = append(args, "-o", "use_path_request_style")
 	}
-	_, err = pwFile.WriteString(pwFileContent)
-	if err != nil {
-		return err
+	if s3fs.insecure {
+		args = append(args, "-o", "no_check_certificate", "-o", "ssl_verify_hostname=0")
 	}
-	pwFile.Close()
-	return nil
+	if cacheDir := config.Get().CacheDir; cacheDir != "" {
+		// s3fs stores its cache in a subdirectory named after the bucket
+		args = append(args, "-o", fmt.Sprintf("use_cache=%s", path.Join(cacheDir, s3fsCmd)))
+	}
+	if s3fs.ownership.uid != nil {
+		args = append(args, "-o", fmt.Sprintf("uid=%d", *s3fs.ownership.uid))
+	}
+	if s3fs.ownership.gid != nil {
+		args = append(args, "-o", fmt.Sprintf("gid=%d", *s3fs.ownership.gid))
+	}
+	if s3fs.ownership.isModeSet() {
+		// s3fs only knows a single umask for files and directories
+		dirMode, _ := s3fs.ownership.modes(0777, 0666)
+		args = append(args, "-o", fmt.Sprintf("umask=%04o", 0777&^dirMode))
+	}
+	return &fuseCommand{Command: s3fsCmd, Args: args, Credentials: s3fs.pwFileContent}
+}
+
+func (s3fs *s3fsMounter) Unstage(stageTarget string) error {
+	return fuseUnmount(stageTarget)
+}
+
+func (s3fs *s3fsMounter) Mount(source string, target string, readOnly bool) error {
+	return bindMount(source, target, readOnly)
 }
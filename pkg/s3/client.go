@@ -3,26 +3,42 @@ package s3
 import (
 	"bytes"
 	"context"
-	"encoding/json"
+	"errors"
 	"fmt"
-	"github.com/golang/glog"
+	"github.com/ctrox/csi-s3/pkg/config"
+	"github.com/ctrox/csi-s3/pkg/logging"
+	"github.com/ctrox/csi-s3/pkg/metrics"
 	"github.com/minio/minio-go/v7"
 	"github.com/minio/minio-go/v7/pkg/credentials"
-	"io"
+	"io/ioutil"
+	"net/http"
 	"net/url"
 	"path"
+	"strings"
+	"time"
 )
 
 const (
 	metadataName = ".metadata.json"
 )
 
+// ErrFSMetaNotFound is returned by GetFSMeta if the volume has no metadata object
+var ErrFSMetaNotFound = errors.New("metadata of volume not found")
+
 type s3Client struct {
 	Config *Config
 	minio  *minio.Client
-	ctx    context.Context
+	// http sends the requests minio-go does not support
+	http *http.Client
+	ctx  context.Context
 }
 
+// ProfileKey is the parameter selecting the endpoint profile of a volume
+const ProfileKey = "profile"
+
+// ErrUnknownProfile is returned by ConfigForProfile if the profile is not configured
+var ErrUnknownProfile = errors.New("unknown endpoint profile")
+
 // Config holds values to configure the driver
 type Config struct {
 	AccessKeyID     string
@@ -30,15 +46,54 @@ type Config struct {
 	Region          string
 	Endpoint        string
 	Mounter         string
+	// Profile is the name of the endpoint profile the configuration is based on
+	Profile string
+	// InsecureSkipVerify disables verification of the TLS certificate of the endpoint
+	InsecureSkipVerify bool
+	// AddressingStyle is config.AddressingPath or config.AddressingVirtual,
+	// empty keeps the default of the client or mounter
+	AddressingStyle string
 }
 
 type FSMeta struct {
+	SchemaVersion int    `json:"SchemaVersion"`
 	BucketName    string `json:"Name"`
+	// Profile is the endpoint profile the volume has been created with
+	Profile string `json:"Profile,omitempty"`
+	// VolumeName is the name of the volume which owns the bucket or prefix,
+	// it is empty for volumes created before it has been recorded
+	VolumeName    string `json:"VolumeName,omitempty"`
 	Prefix        string `json:"Prefix"`
 	UsePrefix     bool   `json:"UsePrefix"`
 	Mounter       string `json:"Mounter"`
 	FSPath        string `json:"FSPath"`
 	CapacityBytes int64  `json:"CapacityBytes"`
+	// FSType and MkfsOptions are only used by block based mounters
+	// such as s3backer. An empty FSType means the mounter default.
+	FSType      string   `json:"FSType,omitempty"`
+	MkfsOptions []string `json:"MkfsOptions,omitempty"`
+	// Ownership of files for object mounters, modes are octal strings.
+	// Empty values keep the defaults of the mounter.
+	UID      string `json:"UID,omitempty"`
+	GID      string `json:"GID,omitempty"`
+	Umask    string `json:"Umask,omitempty"`
+	DirMode  string `json:"DirMode,omitempty"`
+	FileMode string `json:"FileMode,omitempty"`
+	// QuotaEnforcement is what happens when the usage of the volume
+	// exceeds CapacityBytes, UsedBytes and CapacityExceeded are
+	// recorded by the controller when it measures the usage and
+	// QuotaBytes when it sets the bucket quota of the volume
+	QuotaEnforcement string `json:"QuotaEnforcement,omitempty"`
+	UsedBytes        int64  `json:"UsedBytes,omitempty"`
+	CapacityExceeded bool   `json:"CapacityExceeded,omitempty"`
+	QuotaBytes       int64  `json:"QuotaBytes,omitempty"`
+	// ReclaimPolicy is what DeleteVolume removes and BucketCreated
+	// records if the driver has created the bucket for the volume
+	ReclaimPolicy string `json:"ReclaimPolicy,omitempty"`
+	BucketCreated bool   `json:"BucketCreated,omitempty"`
+	// ETag of the metadata object the meta has been read from,
+	// SetFSMeta only overwrites the object if it is unchanged
+	ETag string `json:"-"`
 }
 
 func NewClient(cfg *Config) (*s3Client, error) {
@@ -54,69 +109,132 @@ func NewClient(cfg *Config) (*s3Client, error) {
 	if u.Port() != "" {
 		endpoint = u.Hostname() + ":" + u.Port()
 	}
+	transport, err := minio.DefaultTransport(ssl)
+	if err != nil {
+		return nil, err
+	}
+	if cfg.InsecureSkipVerify && transport.TLSClientConfig != nil {
+		transport.TLSClientConfig.InsecureSkipVerify = true
+	}
+	bucketLookup := minio.BucketLookupAuto
+	switch cfg.AddressingStyle {
+	case config.AddressingPath:
+		bucketLookup = minio.BucketLookupPath
+	case config.AddressingVirtual:
+		bucketLookup = minio.BucketLookupDNS
+	}
 	minioClient, err := minio.New(endpoint, &minio.Options{
-		Creds:  credentials.NewStaticV4(client.Config.AccessKeyID, client.Config.SecretAccessKey, client.Config.Region),
-		Secure: ssl,
+		Creds:        credentials.NewStaticV4(client.Config.AccessKeyID, client.Config.SecretAccessKey, client.Config.Region),
+		Secure:       ssl,
+		Transport:    &conditionalTransport{RoundTripper: transport},
+		BucketLookup: bucketLookup,
 	})
 	if err != nil {
 		return nil, err
 	}
 	client.minio = minioClient
+	client.http = &http.Client{Transport: transport}
 	client.ctx = context.Background()
 	return client, nil
 }
 
 func NewClientFromSecret(secret map[string]string) (*s3Client, error) {
-	return NewClient(&Config{
+	return NewClient(ConfigFromSecret(secret))
+}
+
+// ConfigFromSecret returns the configuration of the S3 endpoint in secret
+func ConfigFromSecret(secret map[string]string) *Config {
+	// endpoint and region fall back to the driver configuration
+	endpoint, region := secret["endpoint"], secret["region"]
+	if endpoint == "" {
+		endpoint = config.Get().DefaultEndpoint
+		if region == "" {
+			region = config.Get().DefaultRegion
+		}
+	}
+	return &Config{
 		AccessKeyID:     secret["accessKeyID"],
 		SecretAccessKey: secret["secretAccessKey"],
-		Region:          secret["region"],
-		Endpoint:        secret["endpoint"],
+		Region:          region,
+		Endpoint:        endpoint,
 		// Mounter is set in the volume preferences, not secrets
 		Mounter: "",
-	})
+	}
+}
+
+// ConfigForProfile returns the configuration of the S3 endpoint of the
+// named profile with the credentials of secret. The endpoint and region
+// of secret are ignored. An empty profile returns ConfigFromSecret.
+func ConfigForProfile(secret map[string]string, profile string) (*Config, error) {
+	if profile == "" {
+		return ConfigFromSecret(secret), nil
+	}
+	p, ok := config.Get().Profile(profile)
+	if !ok {
+		return nil, fmt.Errorf("%w %s", ErrUnknownProfile, profile)
+	}
+	region := p.Region
+	if region == "" {
+		region = config.Get().DefaultRegion
+	}
+	return &Config{
+		AccessKeyID:        secret["accessKeyID"],
+		SecretAccessKey:    secret["secretAccessKey"],
+		Region:             region,
+		Endpoint:           p.Endpoint,
+		Mounter:            p.DefaultMounter,
+		Profile:            profile,
+		InsecureSkipVerify: p.InsecureSkipVerify,
+		AddressingStyle:    p.AddressingStyle,
+	}, nil
 }
 
-func (client *s3Client) BucketExists(bucketName string) (bool, error) {
+func (client *s3Client) BucketExists(bucketName string) (exists bool, err error) {
+	defer metrics.ObserveS3Operation("BucketExists", time.Now(), &err)
 	return client.minio.BucketExists(client.ctx, bucketName)
 }
 
-func (client *s3Client) CreateBucket(bucketName string) error {
+func (client *s3Client) CreateBucket(bucketName string) (err error) {
+	defer metrics.ObserveS3Operation("CreateBucket", time.Now(), &err)
 	return client.minio.MakeBucket(client.ctx, bucketName, minio.MakeBucketOptions{Region: client.Config.Region})
 }
 
-func (client *s3Client) CreatePrefix(bucketName string, prefix string) error {
-	_, err := client.minio.PutObject(client.ctx, bucketName, prefix+"/", bytes.NewReader([]byte("")), 0, minio.PutObjectOptions{})
+func (client *s3Client) CreatePrefix(bucketName string, prefix string) (err error) {
+	defer metrics.ObserveS3Operation("CreatePrefix", time.Now(), &err)
+	_, err = client.minio.PutObject(client.ctx, bucketName, prefix+"/", bytes.NewReader([]byte("")), 0, minio.PutObjectOptions{})
 	if err != nil {
 		return err
 	}
 	return nil
 }
 
-func (client *s3Client) RemovePrefix(bucketName string, prefix string) error {
-	var err error
+func (client *s3Client) RemovePrefix(bucketName string, prefix string) (err error) {
+	defer metrics.ObserveS3Operation("RemovePrefix", time.Now(), &err)
 
-	if err = client.removeObjects(bucketName, prefix); err == nil {
-		return client.minio.RemoveObject(client.ctx, bucketName, prefix, minio.RemoveObjectOptions{})
+	// only remove the objects within the prefix, not those of
+	// prefixes next to it which start with the same name
+	dir := strings.TrimSuffix(prefix, "/") + "/"
+	if err = client.removeObjects(bucketName, dir); err == nil {
+		return client.minio.RemoveObject(client.ctx, bucketName, dir, minio.RemoveObjectOptions{})
 	}
 
-	glog.Warningf("removeObjects failed with: %s, will try removeObjectsOneByOne", err)
+	logging.WarningS("removeObjects failed, will try removeObjectsOneByOne", "bucket", bucketName, "prefix", prefix, "err", err)
 
-	if err = client.removeObjectsOneByOne(bucketName, prefix); err == nil {
-		return client.minio.RemoveObject(client.ctx, bucketName, prefix, minio.RemoveObjectOptions{})
+	if err = client.removeObjectsOneByOne(bucketName, dir); err == nil {
+		return client.minio.RemoveObject(client.ctx, bucketName, dir, minio.RemoveObjectOptions{})
 	}
 
 	return err
 }
 
-func (client *s3Client) RemoveBucket(bucketName string) error {
-	var err error
+func (client *s3Client) RemoveBucket(bucketName string) (err error) {
+	defer metrics.ObserveS3Operation("RemoveBucket", time.Now(), &err)
 
 	if err = client.removeObjects(bucketName, ""); err == nil {
 		return client.minio.RemoveBucket(client.ctx, bucketName)
 	}
 
-	glog.Warningf("removeObjects failed with: %s, will try removeObjectsOneByOne", err)
+	logging.WarningS("removeObjects failed, will try removeObjectsOneByOne", "bucket", bucketName, "err", err)
 
 	if err = client.removeObjectsOneByOne(bucketName, ""); err == nil {
 		return client.minio.RemoveBucket(client.ctx, bucketName)
@@ -125,6 +243,18 @@ func (client *s3Client) RemoveBucket(bucketName string) error {
 	return err
 }
 
+func (client *s3Client) ListObjects(bucketName string, prefix string) (keys []string, err error) {
+	defer metrics.ObserveS3Operation("ListObjects", time.Now(), &err)
+
+	for object := range client.minio.ListObjects(client.ctx, bucketName, minio.ListObjectsOptions{Prefix: prefix}) {
+		if object.Err != nil {
+			return nil, object.Err
+		}
+		keys = append(keys, object.Key)
+	}
+	return keys, nil
+}
+
 func (client *s3Client) removeObjects(bucketName, prefix string) error {
 	objectsCh := make(chan minio.ObjectInfo)
 	var listErr error
@@ -145,7 +275,7 @@ func (client *s3Client) removeObjects(bucketName, prefix string) error {
 	}()
 
 	if listErr != nil {
-		glog.Error("Error listing objects", listErr)
+		logging.ErrorS(listErr, "failed to list objects", "bucket", bucketName, "prefix", prefix)
 		return listErr
 	}
 
@@ -157,7 +287,7 @@ func (client *s3Client) removeObjects(bucketName, prefix string) error {
 		errorCh := client.minio.RemoveObjects(client.ctx, bucketName, objectsCh, opts)
 		haveErrWhenRemoveObjects := false
 		for e := range errorCh {
-			glog.Errorf("Failed to remove object %s, error: %s", e.ObjectName, e.Err)
+			logging.ErrorS(e.Err, "failed to remove object", "bucket", bucketName, "object", e.ObjectName)
 			haveErrWhenRemoveObjects = true
 		}
 		if haveErrWhenRemoveObjects {
@@ -188,7 +318,7 @@ func (client *s3Client) removeObjectsOneByOne(bucketName, prefix string) error {
 	}()
 
 	if listErr != nil {
-		glog.Error("Error listing objects", listErr)
+		logging.ErrorS(listErr, "failed to list objects", "bucket", bucketName, "prefix", prefix)
 		return listErr
 	}
 
@@ -210,7 +340,7 @@ func (client *s3Client) removeObjectsOneByOne(bucketName, prefix string) error {
 
 	haveErrWhenRemoveObjects := false
 	for e := range removeErrCh {
-		glog.Errorf("Failed to remove object %s, error: %s", e.ObjectName, e.Err)
+		logging.ErrorS(e.Err, "failed to remove object", "bucket", bucketName, "object", e.ObjectName)
 		haveErrWhenRemoveObjects = true
 	}
 	if haveErrWhenRemoveObjects {
@@ -220,33 +350,57 @@ func (client *s3Client) removeObjectsOneByOne(bucketName, prefix string) error {
 	return nil
 }
 
-func (client *s3Client) SetFSMeta(meta *FSMeta) error {
-	b := new(bytes.Buffer)
-	json.NewEncoder(b).Encode(meta)
-	opts := minio.PutObjectOptions{ContentType: "application/json"}
-	_, err := client.minio.PutObject(
-		client.ctx, meta.BucketName, path.Join(meta.Prefix, metadataName), b, int64(b.Len()), opts,
+// SetFSMeta writes meta to the metadata object of the volume. If meta has
+// been read with GetFSMeta the object is only replaced if it has not changed
+// since, otherwise it is only created if it does not exist.
+// ErrFSMetaConflict is returned if the condition is not met.
+func (client *s3Client) SetFSMeta(meta *FSMeta) (err error) {
+	defer metrics.ObserveS3Operation("SetFSMeta", time.Now(), &err)
+	b, sum, err := encodeFSMeta(meta)
+	if err != nil {
+		return err
+	}
+	opts := minio.PutObjectOptions{
+		ContentType:  "application/json",
+		UserMetadata: map[string]string{checksumKey: sum},
+	}
+	info, err := client.minio.PutObject(
+		withPrecondition(client.ctx, meta.ETag), meta.BucketName, path.Join(meta.Prefix, metadataName),
+		bytes.NewReader(b), int64(len(b)), opts,
 	)
-	return err
+	if err != nil {
+		if minio.ToErrorResponse(err).StatusCode == http.StatusPreconditionFailed {
+			return ErrFSMetaConflict
+		}
+		return err
+	}
+	meta.ETag = info.ETag
+	return nil
 }
 
-func (client *s3Client) GetFSMeta(bucketName, prefix string) (*FSMeta, error) {
+func (client *s3Client) GetFSMeta(bucketName, prefix string) (_ *FSMeta, err error) {
+	defer metrics.ObserveS3Operation("GetFSMeta", time.Now(), &err)
 	opts := minio.GetObjectOptions{}
 	obj, err := client.minio.GetObject(client.ctx, bucketName, path.Join(prefix, metadataName), opts)
 	if err != nil {
 		return &FSMeta{}, err
 	}
+	defer obj.Close()
 	objInfo, err := obj.Stat()
 	if err != nil {
+		if minio.ToErrorResponse(err).Code == "NoSuchKey" {
+			return &FSMeta{}, ErrFSMetaNotFound
+		}
 		return &FSMeta{}, err
 	}
-	b := make([]byte, objInfo.Size)
-	_, err = obj.Read(b)
-
-	if err != nil && err != io.EOF {
+	b, err := ioutil.ReadAll(obj)
+	if err != nil {
 		return &FSMeta{}, err
 	}
-	var meta FSMeta
-	err = json.Unmarshal(b, &meta)
-	return &meta, err
+	meta, err := decodeFSMeta(b, objInfo.UserMetadata[checksumKey])
+	if err != nil {
+		return &FSMeta{}, fmt.Errorf("invalid metadata of volume %s: %w", path.Join(bucketName, prefix), err)
+	}
+	meta.ETag = objInfo.ETag
+	return meta, nil
 }
@@ -0,0 +1,53 @@
+package s3
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/ctrox/csi-s3/pkg/config"
+)
+
+func TestConfigForProfile(t *testing.T) {
+	cfg := config.Default()
+	cfg.Profiles = map[string]config.Profile{
+		"minio": {
+			Endpoint:           "https://minio:9000",
+			InsecureSkipVerify: true,
+			AddressingStyle:    config.AddressingPath,
+			DefaultMounter:     "rclone",
+		},
+	}
+	defer config.Set(config.Get())
+	config.Set(cfg)
+	secret := map[string]string{
+		"accessKeyID":     "key",
+		"secretAccessKey": "secret",
+		"endpoint":        "https://s3.amazonaws.com",
+		"region":          "eu-west-1",
+	}
+
+	c, err := ConfigForProfile(secret, "minio")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	want := Config{
+		AccessKeyID:        "key",
+		SecretAccessKey:    "secret",
+		Region:             cfg.DefaultRegion,
+		Endpoint:           "https://minio:9000",
+		Mounter:            "rclone",
+		Profile:            "minio",
+		InsecureSkipVerify: true,
+		AddressingStyle:    config.AddressingPath,
+	}
+	if *c != want {
+		t.Errorf("ConfigForProfile() = %+v, want %+v", *c, want)
+	}
+
+	if c, err := ConfigForProfile(secret, ""); err != nil || c.Endpoint != "https://s3.amazonaws.com" || c.Region != "eu-west-1" {
+		t.Errorf("expected the endpoint of the secret without a profile, got %+v, %v", c, err)
+	}
+	if _, err := ConfigForProfile(secret, "aws"); !errors.Is(err, ErrUnknownProfile) {
+		t.Errorf("expected ErrUnknownProfile, got %v", err)
+	}
+}
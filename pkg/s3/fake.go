@@ -0,0 +1,330 @@
+package s3
+
+import (
+	"crypto/md5"
+	"encoding/hex"
+	"fmt"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// FakeObjectStore is an in-memory ObjectStore for tests. Like the ETag of a
+// single PUT on S3 the ETag of an object is the md5 of its content, so
+// conditional metadata writes behave like on S3. Errors of operations can
+// be injected with SetError.
+type FakeObjectStore struct {
+	mu      sync.Mutex
+	buckets map[string]map[string]*fakeObject
+	errors  map[string]error
+	quotas  map[string]int64
+}
+
+type fakeObject struct {
+	data         []byte
+	userMetadata map[string]string
+	etag         string
+}
+
+var _ ObjectStore = &FakeObjectStore{}
+
+// NewFakeObjectStore returns an empty FakeObjectStore
+func NewFakeObjectStore() *FakeObjectStore {
+	return &FakeObjectStore{
+		buckets: map[string]map[string]*fakeObject{},
+		errors:  map[string]error{},
+		quotas:  map[string]int64{},
+	}
+}
+
+// SetError makes operation, e.g. "CreateBucket", fail with err until it is reset with a nil err
+func (f *FakeObjectStore) SetError(operation string, err error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err == nil {
+		delete(f.errors, operation)
+		return
+	}
+	f.errors[operation] = err
+}
+
+// PutObject stores an object with data in the bucket, creating the bucket if needed
+func (f *FakeObjectStore) PutObject(bucketName, key string, data []byte) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.buckets[bucketName] == nil {
+		f.buckets[bucketName] = map[string]*fakeObject{}
+	}
+	f.put(bucketName, key, data, nil)
+}
+
+// Objects returns the sorted keys of all objects in the bucket
+func (f *FakeObjectStore) Objects(bucketName string) []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	keys := []string{}
+	for key := range f.buckets[bucketName] {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func (f *FakeObjectStore) BucketExists(bucketName string) (bool, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.errors["BucketExists"]; err != nil {
+		return false, err
+	}
+	_, ok := f.buckets[bucketName]
+	return ok, nil
+}
+
+func (f *FakeObjectStore) CreateBucket(bucketName string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.errors["CreateBucket"]; err != nil {
+		return err
+	}
+	if _, ok := f.buckets[bucketName]; ok {
+		return fmt.Errorf("bucket %s already exists", bucketName)
+	}
+	f.buckets[bucketName] = map[string]*fakeObject{}
+	return nil
+}
+
+func (f *FakeObjectStore) CreatePrefix(bucketName string, prefix string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.errors["CreatePrefix"]; err != nil {
+		return err
+	}
+	if _, ok := f.buckets[bucketName]; !ok {
+		return fmt.Errorf("bucket %s does not exist", bucketName)
+	}
+	f.put(bucketName, prefix+"/", nil, nil)
+	return nil
+}
+
+func (f *FakeObjectStore) RemovePrefix(bucketName string, prefix string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.errors["RemovePrefix"]; err != nil {
+		return err
+	}
+	objects, ok := f.buckets[bucketName]
+	if !ok {
+		return fmt.Errorf("bucket %s does not exist", bucketName)
+	}
+	dir := strings.TrimSuffix(prefix, "/") + "/"
+	for key := range objects {
+		if strings.HasPrefix(key, dir) {
+			delete(objects, key)
+		}
+	}
+	return nil
+}
+
+func (f *FakeObjectStore) ListObjects(bucketName string, prefix string) ([]string, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.errors["ListObjects"]; err != nil {
+		return nil, err
+	}
+	objects, ok := f.buckets[bucketName]
+	if !ok {
+		return nil, fmt.Errorf("bucket %s does not exist", bucketName)
+	}
+	found := map[string]bool{}
+	for key := range objects {
+		if !strings.HasPrefix(key, prefix) {
+			continue
+		}
+		if i := strings.Index(key[len(prefix):], "/"); i >= 0 {
+			key = key[:len(prefix)+i+1]
+		}
+		found[key] = true
+	}
+	keys := []string{}
+	for key := range found {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys, nil
+}
+
+func (f *FakeObjectStore) PrefixUsage(bucketName string, prefix string) (int64, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.errors["PrefixUsage"]; err != nil {
+		return 0, err
+	}
+	objects, ok := f.buckets[bucketName]
+	if !ok {
+		return 0, fmt.Errorf("bucket %s does not exist", bucketName)
+	}
+	dir := ""
+	if prefix != "" {
+		dir = prefix + "/"
+	}
+	var usage int64
+	for key, obj := range objects {
+		if strings.HasPrefix(key, dir) {
+			usage += int64(len(obj.data))
+		}
+	}
+	return usage, nil
+}
+
+func (f *FakeObjectStore) SetBucketQuota(bucketName string, quotaBytes int64) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.errors["SetBucketQuota"]; err != nil {
+		return err
+	}
+	if _, ok := f.buckets[bucketName]; !ok {
+		return fmt.Errorf("bucket %s does not exist", bucketName)
+	}
+	f.quotas[bucketName] = quotaBytes
+	return nil
+}
+
+// BucketQuota returns the quota set on a bucket, zero if there is none
+func (f *FakeObjectStore) BucketQuota(bucketName string) int64 {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.quotas[bucketName]
+}
+
+func (f *FakeObjectStore) RemoveBucket(bucketName string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.errors["RemoveBucket"]; err != nil {
+		return err
+	}
+	if _, ok := f.buckets[bucketName]; !ok {
+		return fmt.Errorf("bucket %s does not exist", bucketName)
+	}
+	delete(f.buckets, bucketName)
+	return nil
+}
+
+func (f *FakeObjectStore) GetFSMeta(bucketName, prefix string) (*FSMeta, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.errors["GetFSMeta"]; err != nil {
+		return &FSMeta{}, err
+	}
+	obj, ok := f.buckets[bucketName][path.Join(prefix, metadataName)]
+	if !ok {
+		return &FSMeta{}, ErrFSMetaNotFound
+	}
+	meta, err := decodeFSMeta(obj.data, obj.userMetadata[checksumKey])
+	if err != nil {
+		return &FSMeta{}, err
+	}
+	meta.ETag = obj.etag
+	return meta, nil
+}
+
+func (f *FakeObjectStore) SetFSMeta(meta *FSMeta) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.errors["SetFSMeta"]; err != nil {
+		return err
+	}
+	b, sum, err := encodeFSMeta(meta)
+	if err != nil {
+		return err
+	}
+	etag, err := f.putIfMatch(meta.BucketName, path.Join(meta.Prefix, metadataName), meta.ETag, b, map[string]string{checksumKey: sum})
+	if err != nil {
+		return err
+	}
+	meta.ETag = etag
+	return nil
+}
+
+func (f *FakeObjectStore) MetaStore(storeType string, volumeContext map[string]string) (MetaStore, error) {
+	switch storeType {
+	case "", MetaStoreObject:
+		return f, nil
+	case MetaStoreMarker:
+		return &fakeMarkerMetaStore{fake: f}, nil
+	case MetaStoreContext:
+		return &contextMetaStore{volumeContext: volumeContext}, nil
+	}
+	return nil, fmt.Errorf("unknown metadata store %s", storeType)
+}
+
+// putIfMatch stores the object if its ETag matches etag,
+// an empty etag only allows creating the object
+func (f *FakeObjectStore) putIfMatch(bucketName, key, etag string, data []byte, userMetadata map[string]string) (string, error) {
+	objects, ok := f.buckets[bucketName]
+	if !ok {
+		return "", fmt.Errorf("bucket %s does not exist", bucketName)
+	}
+	existing, exists := objects[key]
+	if (etag == "" && exists) || (etag != "" && (!exists || existing.etag != etag)) {
+		return "", ErrFSMetaConflict
+	}
+	return f.put(bucketName, key, data, userMetadata), nil
+}
+
+func (f *FakeObjectStore) put(bucketName, key string, data []byte, userMetadata map[string]string) string {
+	sum := md5.Sum(data)
+	etag := hex.EncodeToString(sum[:])
+	f.buckets[bucketName][key] = &fakeObject{data: data, userMetadata: userMetadata, etag: etag}
+	return etag
+}
+
+// fakeMarkerMetaStore keeps the metadata in the content
+// of the prefix marker like markerMetaStore
+type fakeMarkerMetaStore struct {
+	fake *FakeObjectStore
+}
+
+func (m *fakeMarkerMetaStore) GetFSMeta(bucketName, prefix string) (*FSMeta, error) {
+	m.fake.mu.Lock()
+	defer m.fake.mu.Unlock()
+	if err := m.fake.errors["GetFSMeta"]; err != nil {
+		return &FSMeta{}, err
+	}
+	obj, ok := m.fake.buckets[bucketName][prefix+"/"]
+	if prefix == "" || !ok || len(obj.data) == 0 {
+		return &FSMeta{}, ErrFSMetaNotFound
+	}
+	meta, err := decodeFSMeta(obj.data, obj.userMetadata[checksumKey])
+	if err != nil {
+		return &FSMeta{}, err
+	}
+	meta.ETag = obj.etag
+	return meta, nil
+}
+
+func (m *fakeMarkerMetaStore) SetFSMeta(meta *FSMeta) error {
+	m.fake.mu.Lock()
+	defer m.fake.mu.Unlock()
+	if err := m.fake.errors["SetFSMeta"]; err != nil {
+		return err
+	}
+	if meta.Prefix == "" {
+		return fmt.Errorf("metadata store %s requires a prefix", MetaStoreMarker)
+	}
+	key := meta.Prefix + "/"
+	etag := meta.ETag
+	if obj, ok := m.fake.buckets[meta.BucketName][key]; ok && etag == "" && len(obj.data) == 0 {
+		etag = obj.etag
+	}
+	b, sum, err := encodeFSMeta(meta)
+	if err != nil {
+		return err
+	}
+	etag, err = m.fake.putIfMatch(meta.BucketName, key, etag, b, map[string]string{checksumKey: sum})
+	if err != nil {
+		return err
+	}
+	meta.ETag = etag
+	return nil
+}
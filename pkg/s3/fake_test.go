@@ -0,0 +1,60 @@
+package s3
+
+import (
+	"crypto/md5"
+	"encoding/hex"
+	"testing"
+)
+
+func TestFakeObjectStoreConditionalWrites(t *testing.T) {
+	for _, storeType := range []string{MetaStoreObject, MetaStoreMarker} {
+		t.Run(storeType, func(t *testing.T) {
+			f := NewFakeObjectStore()
+			if err := f.CreateBucket("bucket"); err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			store, err := f.MetaStore(storeType, nil)
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			meta := &FSMeta{BucketName: "bucket", Prefix: "pvc"}
+			if err := store.SetFSMeta(meta); err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			first, err := store.GetFSMeta("bucket", "pvc")
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			second, _ := store.GetFSMeta("bucket", "pvc")
+
+			// metadata can only be created once
+			if err := store.SetFSMeta(&FSMeta{BucketName: "bucket", Prefix: "pvc"}); err != ErrFSMetaConflict {
+				t.Errorf("expected ErrFSMetaConflict, got %v", err)
+			}
+			first.Mounter = "rclone"
+			if err := store.SetFSMeta(first); err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			// the second reader has seen an old version
+			second.Mounter = "s3fs"
+			if err := store.SetFSMeta(second); err != ErrFSMetaConflict {
+				t.Errorf("expected ErrFSMetaConflict, got %v", err)
+			}
+			if meta, _ := store.GetFSMeta("bucket", "pvc"); meta.Mounter != "rclone" {
+				t.Errorf("expected the first update to be kept, got %+v", meta)
+			}
+		})
+	}
+}
+
+func TestFakeObjectStoreETag(t *testing.T) {
+	f := NewFakeObjectStore()
+	f.PutObject("bucket", "a", []byte("data"))
+	f.PutObject("bucket", "b", []byte("data"))
+	sum := md5.Sum([]byte("data"))
+	for _, key := range []string{"a", "b"} {
+		if etag := f.buckets["bucket"][key].etag; etag != hex.EncodeToString(sum[:]) {
+			t.Errorf("expected the md5 of the content as ETag of %s, got %s", key, etag)
+		}
+	}
+}
@@ -0,0 +1,181 @@
+package s3
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"reflect"
+	"sort"
+	"strings"
+
+	"github.com/ctrox/csi-s3/pkg/logging"
+)
+
+const (
+	// fsMetaSchemaVersion is the version of FSMeta written by this driver
+	fsMetaSchemaVersion = 2
+	// checksumKey is the user metadata of the metadata object holding
+	// the sha256 of its content
+	checksumKey = "Checksum"
+	// legacyFSPath is where volumes created before FSPath existed store their data
+	legacyFSPath = "csi-fs"
+)
+
+// ErrFSMetaConflict is returned by SetFSMeta if the metadata
+// has been changed since it was read
+var ErrFSMetaConflict = errors.New("metadata of volume has been modified concurrently")
+
+// ErrFSMetaNewer is returned by SetFSMeta for metadata written by a newer
+// version of the driver. Rewriting it would drop the fields this version
+// does not know, so it is read only until the driver is upgraded again.
+var ErrFSMetaNewer = errors.New("metadata of volume has been written by a newer version of the driver")
+
+// CheckSchemaVersion returns ErrFSMetaNewer if meta has been
+// written with a newer schema version than this driver supports
+func CheckSchemaVersion(meta *FSMeta) error {
+	if meta.SchemaVersion > fsMetaSchemaVersion {
+		return fmt.Errorf("%w: schema version %d, supported version %d", ErrFSMetaNewer, meta.SchemaVersion, fsMetaSchemaVersion)
+	}
+	return nil
+}
+
+// fsMetaMigrations migrate the decoded json of a metadata object,
+// the migration at index n upgrades schema version n to n+1
+var fsMetaMigrations = []func(fields map[string]interface{}){
+	// 0 to 1: unversioned metadata without FSPath stored its data in csi-fs
+	func(fields map[string]interface{}) {
+		if _, ok := fields["FSPath"]; !ok {
+			fields["FSPath"] = legacyFSPath
+		}
+	},
+	// 1 to 2: volumes without reclaim policy removed their prefix unless
+	// usePrefix was set or else their bucket, regardless of who created it
+	func(fields map[string]interface{}) {
+		if _, ok := fields["ReclaimPolicy"]; ok {
+			return
+		}
+		usePrefix, _ := fields["UsePrefix"].(bool)
+		prefix, _ := fields["Prefix"].(string)
+		policy := DefaultReclaimPolicy(usePrefix, prefix)
+		fields["ReclaimPolicy"] = policy
+		fields["BucketCreated"] = policy == ReclaimDeleteBucket
+	},
+}
+
+// encodeFSMeta returns the json of meta in the current
+// schema version and its checksum. Metadata of newer
+// schema versions is refused with ErrFSMetaNewer.
+func encodeFSMeta(meta *FSMeta) ([]byte, string, error) {
+	if err := CheckSchemaVersion(meta); err != nil {
+		return nil, "", err
+	}
+	meta.SchemaVersion = fsMetaSchemaVersion
+	b, err := json.Marshal(meta)
+	if err != nil {
+		return nil, "", err
+	}
+	return b, checksum(b), nil
+}
+
+// decodeFSMeta verifies b against sum, if set, and decodes it migrating
+// older schema versions. Fields unknown to this driver are logged and
+// ignored, the schema version of newer metadata is kept so it is not
+// rewritten without them.
+func decodeFSMeta(b []byte, sum string) (*FSMeta, error) {
+	if sum != "" && sum != checksum(b) {
+		return nil, fmt.Errorf("checksum mismatch of metadata, expected %s got %s", sum, checksum(b))
+	}
+	fields := map[string]interface{}{}
+	if err := json.Unmarshal(b, &fields); err != nil {
+		return nil, err
+	}
+	version := 0
+	if v, ok := fields["SchemaVersion"].(float64); ok {
+		version = int(v)
+	}
+	if version > fsMetaSchemaVersion {
+		logging.WarningS("metadata schema version is newer than the supported version, it is read only", "version", version, "supportedVersion", fsMetaSchemaVersion)
+	}
+	for ; version < fsMetaSchemaVersion; version++ {
+		fsMetaMigrations[version](fields)
+	}
+	if unknown := unknownFSMetaFields(fields); len(unknown) > 0 {
+		logging.WarningS("ignoring unknown metadata fields", "fields", unknown)
+		for _, name := range unknown {
+			delete(fields, name)
+		}
+	}
+	fields["SchemaVersion"] = version
+
+	migrated, err := json.Marshal(fields)
+	if err != nil {
+		return nil, err
+	}
+	dec := json.NewDecoder(bytes.NewReader(migrated))
+	dec.DisallowUnknownFields()
+	meta := &FSMeta{}
+	if err := dec.Decode(meta); err != nil {
+		return nil, err
+	}
+	return meta, nil
+}
+
+// unknownFSMetaFields returns the sorted names of fields FSMeta has no json field for
+func unknownFSMetaFields(fields map[string]interface{}) []string {
+	known := map[string]bool{}
+	t := reflect.TypeOf(FSMeta{})
+	for i := 0; i < t.NumField(); i++ {
+		name := strings.Split(t.Field(i).Tag.Get("json"), ",")[0]
+		if name != "" && name != "-" {
+			known[name] = true
+		}
+	}
+	unknown := []string{}
+	for name := range fields {
+		if !known[name] {
+			unknown = append(unknown, name)
+		}
+	}
+	sort.Strings(unknown)
+	return unknown
+}
+
+func checksum(b []byte) string {
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:])
+}
+
+type preconditionKey struct{}
+
+type precondition struct {
+	header string
+	value  string
+}
+
+// withPrecondition makes PUT requests made with the returned context conditional.
+// An empty etag only allows creating the object, otherwise it has to match.
+func withPrecondition(ctx context.Context, etag string) context.Context {
+	if etag == "" {
+		return context.WithValue(ctx, preconditionKey{}, precondition{header: "If-None-Match", value: "*"})
+	}
+	return context.WithValue(ctx, preconditionKey{}, precondition{header: "If-Match", value: fmt.Sprintf("%q", etag)})
+}
+
+// conditionalTransport adds the precondition of the request context
+// to PUT requests, minio-go does not support conditional writes itself.
+type conditionalTransport struct {
+	http.RoundTripper
+}
+
+func (t *conditionalTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if p, ok := req.Context().Value(preconditionKey{}).(precondition); ok && req.Method == http.MethodPut {
+		req = req.Clone(req.Context())
+		req.Header.Set(p.header, p.value)
+	}
+	return t.RoundTripper.RoundTrip(req)
+}
@@ -0,0 +1,114 @@
+package s3
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestDecodeFSMeta(t *testing.T) {
+	// unversioned metadata written before FSPath existed
+	meta, err := decodeFSMeta([]byte(`{"Name":"bucket","Prefix":"pvc","Mounter":"s3fs","CapacityBytes":1}`), "")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if meta.SchemaVersion != fsMetaSchemaVersion || meta.FSPath != legacyFSPath || meta.BucketName != "bucket" {
+		t.Errorf("legacy metadata has not been migrated: %+v", meta)
+	}
+
+	if meta.ReclaimPolicy != ReclaimDeletePrefix || meta.BucketCreated {
+		t.Errorf("expected the prefix of legacy metadata to be reclaimed: %+v", meta)
+	}
+	meta, err = decodeFSMeta([]byte(`{"SchemaVersion":1,"Name":"bucket","Prefix":"","FSPath":"csi-fs"}`), "")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if meta.ReclaimPolicy != ReclaimDeleteBucket || !meta.BucketCreated {
+		t.Errorf("expected the bucket of legacy metadata to be reclaimed: %+v", meta)
+	}
+
+	// an empty FSPath is kept
+	meta, err = decodeFSMeta([]byte(`{"Name":"bucket","FSPath":"","UsePrefix":true}`), "")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if meta.FSPath != "" || !meta.UsePrefix || meta.ReclaimPolicy != ReclaimRetain {
+		t.Errorf("unexpected metadata: %+v", meta)
+	}
+
+	// unknown fields of newer drivers are ignored
+	meta, err = decodeFSMeta([]byte(`{"SchemaVersion":1,"Name":"bucket","FSPath":"csi-fs","Future":true}`), "")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if meta.BucketName != "bucket" {
+		t.Errorf("unexpected metadata: %+v", meta)
+	}
+
+	// metadata of newer drivers cannot be written
+	meta, err = decodeFSMeta([]byte(`{"SchemaVersion":99,"Name":"bucket","FSPath":"csi-fs","Future":true}`), "")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if _, _, err := encodeFSMeta(meta); !errors.Is(err, ErrFSMetaNewer) {
+		t.Errorf("expected newer metadata to be refused, got %v", err)
+	}
+
+	// wrong types are rejected
+	if _, err := decodeFSMeta([]byte(`{"Name":"bucket","CapacityBytes":"big"}`), ""); err == nil {
+		t.Error("expected an error for an invalid field type")
+	}
+}
+
+func TestFSMetaChecksum(t *testing.T) {
+	b, sum, err := encodeFSMeta(&FSMeta{BucketName: "bucket", FSPath: "csi-fs", ETag: "abc"})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	meta, err := decodeFSMeta(b, sum)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if meta.BucketName != "bucket" || meta.ETag != "" || meta.SchemaVersion != fsMetaSchemaVersion {
+		t.Errorf("unexpected metadata: %+v", meta)
+	}
+	b[len(b)-2] = ' '
+	if _, err := decodeFSMeta(b, sum); err == nil {
+		t.Error("expected an error for a corrupted metadata object")
+	}
+}
+
+func TestConditionalTransport(t *testing.T) {
+	headers := http.Header{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		headers = r.Header
+	}))
+	defer server.Close()
+	client := &http.Client{Transport: &conditionalTransport{RoundTripper: http.DefaultTransport}}
+
+	for _, tc := range []struct {
+		method string
+		etag   string
+		header string
+		value  string
+	}{
+		{http.MethodPut, "", "If-None-Match", "*"},
+		{http.MethodPut, "abc", "If-Match", `"abc"`},
+		{http.MethodGet, "abc", "If-Match", ""},
+	} {
+		req, err := http.NewRequestWithContext(withPrecondition(context.Background(), tc.etag), tc.method, server.URL, nil)
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		resp.Body.Close()
+		if got := headers.Get(tc.header); got != tc.value {
+			t.Errorf("%s with etag %q: expected %s %q, got %q", tc.method, tc.etag, tc.header, tc.value, got)
+		}
+	}
+}
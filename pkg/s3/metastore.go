@@ -0,0 +1,173 @@
+package s3
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"time"
+
+	"github.com/ctrox/csi-s3/pkg/metrics"
+	"github.com/minio/minio-go/v7"
+)
+
+const (
+	// MetaStoreKey selects the metadata store of a volume
+	// in the storage class parameters
+	MetaStoreKey = "metadataStore"
+	// MetaStoreObject stores the metadata in a .metadata.json object
+	// in the bucket or prefix of the volume
+	MetaStoreObject = "object"
+	// MetaStoreMarker stores the metadata in the content
+	// of the marker object of the prefix of the volume
+	MetaStoreMarker = "marker"
+	// MetaStoreContext stores the metadata in the volume context
+	MetaStoreContext = "context"
+
+	// contextMetaKey is the volume context entry holding the metadata
+	contextMetaKey = "fsMeta"
+)
+
+// MetaStore reads and writes the metadata of volumes
+type MetaStore interface {
+	GetFSMeta(bucketName, prefix string) (*FSMeta, error)
+	SetFSMeta(meta *FSMeta) error
+}
+
+// IsSupportedMetaStore returns true if storeType is a known metadata store,
+// an empty type is the object store
+func IsSupportedMetaStore(storeType string) bool {
+	switch storeType {
+	case "", MetaStoreObject, MetaStoreMarker, MetaStoreContext:
+		return true
+	}
+	return false
+}
+
+// MetaStore returns the metadata store of type storeType. The context
+// store reads from and writes to volumeContext.
+func (client *s3Client) MetaStore(storeType string, volumeContext map[string]string) (MetaStore, error) {
+	switch storeType {
+	case "", MetaStoreObject:
+		return client, nil
+	case MetaStoreMarker:
+		return &markerMetaStore{client: client}, nil
+	case MetaStoreContext:
+		return &contextMetaStore{volumeContext: volumeContext}, nil
+	}
+	return nil, fmt.Errorf("unknown metadata store %s", storeType)
+}
+
+// markerMetaStore keeps the metadata in the content of the prefix/ marker
+// object, so it is not visible in the mounted volume. The ETag of S3 is
+// derived from the content, so it changes with every change of the
+// metadata and can be used for conditional writes.
+// Volumes without a prefix have no marker and cannot use it.
+type markerMetaStore struct {
+	client *s3Client
+}
+
+func (m *markerMetaStore) GetFSMeta(bucketName, prefix string) (_ *FSMeta, err error) {
+	defer metrics.ObserveS3Operation("GetFSMeta", time.Now(), &err)
+	if prefix == "" {
+		return &FSMeta{}, ErrFSMetaNotFound
+	}
+	obj, err := m.client.minio.GetObject(m.client.ctx, bucketName, prefix+"/", minio.GetObjectOptions{})
+	if err != nil {
+		return &FSMeta{}, err
+	}
+	defer obj.Close()
+	info, err := obj.Stat()
+	if err != nil {
+		if minio.ToErrorResponse(err).Code == "NoSuchKey" {
+			return &FSMeta{}, ErrFSMetaNotFound
+		}
+		return &FSMeta{}, err
+	}
+	// the empty marker of a prefix created without metadata
+	if info.Size == 0 {
+		return &FSMeta{}, ErrFSMetaNotFound
+	}
+	b, err := ioutil.ReadAll(obj)
+	if err != nil {
+		return &FSMeta{}, err
+	}
+	meta, err := decodeFSMeta(b, info.UserMetadata[checksumKey])
+	if err != nil {
+		return &FSMeta{}, fmt.Errorf("invalid metadata of volume %s/%s: %w", bucketName, prefix, err)
+	}
+	meta.ETag = info.ETag
+	return meta, nil
+}
+
+func (m *markerMetaStore) SetFSMeta(meta *FSMeta) (err error) {
+	defer metrics.ObserveS3Operation("SetFSMeta", time.Now(), &err)
+	if meta.Prefix == "" {
+		return fmt.Errorf("metadata store %s requires a prefix", MetaStoreMarker)
+	}
+	key := meta.Prefix + "/"
+	etag := meta.ETag
+	if etag == "" {
+		// a marker without metadata may be replaced, e.g. of an existing prefix
+		info, err := m.client.minio.StatObject(m.client.ctx, meta.BucketName, key, minio.StatObjectOptions{})
+		if err == nil && info.Size == 0 {
+			etag = info.ETag
+		} else if err != nil && minio.ToErrorResponse(err).Code != "NoSuchKey" {
+			return err
+		}
+	}
+	b, sum, err := encodeFSMeta(meta)
+	if err != nil {
+		return err
+	}
+	opts := minio.PutObjectOptions{
+		UserMetadata: map[string]string{checksumKey: sum},
+	}
+	info, err := m.client.minio.PutObject(
+		withPrecondition(m.client.ctx, etag), meta.BucketName, key, bytes.NewReader(b), int64(len(b)), opts,
+	)
+	if err != nil {
+		if minio.ToErrorResponse(err).StatusCode == http.StatusPreconditionFailed {
+			return ErrFSMetaConflict
+		}
+		return err
+	}
+	meta.ETag = info.ETag
+	return nil
+}
+
+// contextMetaStore keeps the metadata in the volume context returned by
+// CreateVolume. Nothing is written to the bucket, but the metadata is not
+// available in calls without a volume context such as DeleteVolume.
+type contextMetaStore struct {
+	volumeContext map[string]string
+}
+
+func (c *contextMetaStore) GetFSMeta(bucketName, prefix string) (*FSMeta, error) {
+	encoded := c.volumeContext[contextMetaKey]
+	if encoded == "" {
+		return &FSMeta{}, ErrFSMetaNotFound
+	}
+	b, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return &FSMeta{}, fmt.Errorf("invalid metadata in volume context: %w", err)
+	}
+	meta, err := decodeFSMeta(b, "")
+	if err != nil {
+		return &FSMeta{}, fmt.Errorf("invalid metadata in volume context: %w", err)
+	}
+	return meta, nil
+}
+
+func (c *contextMetaStore) SetFSMeta(meta *FSMeta) error {
+	if c.volumeContext == nil {
+		return fmt.Errorf("metadata store %s requires a volume context", MetaStoreContext)
+	}
+	b, _, err := encodeFSMeta(meta)
+	if err != nil {
+		return err
+	}
+	c.volumeContext[contextMetaKey] = base64.StdEncoding.EncodeToString(b)
+	return nil
+}
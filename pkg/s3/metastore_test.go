@@ -0,0 +1,164 @@
+package s3
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"github.com/johannesboyne/gofakes3"
+	"github.com/johannesboyne/gofakes3/backend/s3mem"
+)
+
+func TestContextMetaStore(t *testing.T) {
+	client := &s3Client{}
+	volumeContext := map[string]string{"mounter": "rclone"}
+	store, err := client.MetaStore(MetaStoreContext, volumeContext)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if _, err := store.GetFSMeta("bucket", "pvc"); err != ErrFSMetaNotFound {
+		t.Errorf("expected ErrFSMetaNotFound, got %v", err)
+	}
+	if err := store.SetFSMeta(&FSMeta{BucketName: "bucket", Prefix: "pvc", Mounter: "rclone", FSPath: "csi-fs"}); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if volumeContext[contextMetaKey] == "" {
+		t.Fatal("expected metadata to be stored in the volume context")
+	}
+	meta, err := store.GetFSMeta("bucket", "pvc")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if meta.BucketName != "bucket" || meta.Prefix != "pvc" || meta.Mounter != "rclone" || meta.FSPath != "csi-fs" {
+		t.Errorf("unexpected metadata: %+v", meta)
+	}
+
+	if _, err := client.MetaStore("configmap", nil); err == nil || IsSupportedMetaStore("configmap") {
+		t.Error("expected an error for an unknown metadata store")
+	}
+}
+
+func TestMarkerMetaStore(t *testing.T) {
+	server := newFakeS3Server()
+	defer server.Close()
+	client, err := NewClient(&Config{Endpoint: server.URL, AccessKeyID: "key", SecretAccessKey: "secret"})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if err := client.CreateBucket("bucket"); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	store, err := client.MetaStore(MetaStoreMarker, nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	if _, err := store.GetFSMeta("bucket", "pvc"); err != ErrFSMetaNotFound {
+		t.Errorf("expected ErrFSMetaNotFound for a missing marker, got %v", err)
+	}
+	// the marker of an existing prefix is replaced
+	if err := client.CreatePrefix("bucket", "pvc"); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if _, err := store.GetFSMeta("bucket", "pvc"); err != ErrFSMetaNotFound {
+		t.Errorf("expected ErrFSMetaNotFound for a marker without metadata, got %v", err)
+	}
+	if err := store.SetFSMeta(&FSMeta{BucketName: "bucket", Prefix: "pvc", Mounter: "rclone", FSPath: "csi-fs"}); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	meta, err := store.GetFSMeta("bucket", "pvc")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if meta.BucketName != "bucket" || meta.Prefix != "pvc" || meta.Mounter != "rclone" || meta.FSPath != "csi-fs" || meta.ETag == "" {
+		t.Errorf("unexpected metadata: %+v", meta)
+	}
+	if objects, _ := client.ListObjects("bucket", "pvc/"); len(objects) != 0 {
+		t.Errorf("expected the metadata not to be visible in the volume, got %v", objects)
+	}
+	meta.Mounter = "s3fs"
+	if err := store.SetFSMeta(meta); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if meta, err := store.GetFSMeta("bucket", "pvc"); err != nil || meta.Mounter != "s3fs" {
+		t.Errorf("expected updated metadata, got %+v, %v", meta, err)
+	}
+
+	// two writers which have read the same metadata conflict
+	// even if the second one does not change anything
+	first, err := store.GetFSMeta("bucket", "pvc")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	second, err := store.GetFSMeta("bucket", "pvc")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	first.UsedBytes = 1024
+	if err := store.SetFSMeta(first); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if err := store.SetFSMeta(second); err != ErrFSMetaConflict {
+		t.Errorf("expected ErrFSMetaConflict for a concurrent update, got %v", err)
+	}
+	if meta, err := store.GetFSMeta("bucket", "pvc"); err != nil || meta.UsedBytes != 1024 {
+		t.Errorf("expected the first update to be kept, got %+v, %v", meta, err)
+	}
+	// only the first of two volumes taking over a marker without metadata wins
+	if err := client.CreatePrefix("bucket", "shared"); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if err := store.SetFSMeta(&FSMeta{BucketName: "bucket", Prefix: "shared", Mounter: "rclone"}); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if err := store.SetFSMeta(&FSMeta{BucketName: "bucket", Prefix: "shared", Mounter: "s3fs"}); err != ErrFSMetaConflict {
+		t.Errorf("expected ErrFSMetaConflict for an existing marker with metadata, got %v", err)
+	}
+
+	if _, err := store.GetFSMeta("bucket", ""); err != ErrFSMetaNotFound {
+		t.Errorf("expected ErrFSMetaNotFound for a volume without prefix, got %v", err)
+	}
+	if err := store.SetFSMeta(&FSMeta{BucketName: "bucket"}); err == nil {
+		t.Error("expected an error for a volume without prefix")
+	}
+}
+
+// newFakeS3Server returns an in-memory S3 server which accepts the
+// streaming uploads of minio-go without a Content-Length header. Like
+// S3 it checks the If-Match and If-None-Match preconditions of PUT
+// requests against the ETag of the object, which gofakes3 ignores.
+func newFakeS3Server() *httptest.Server {
+	h := gofakes3.New(s3mem.New()).Server()
+	var mu sync.Mutex
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPut {
+			h.ServeHTTP(w, r)
+			return
+		}
+		if decoded := r.Header.Get("X-Amz-Decoded-Content-Length"); decoded != "" {
+			r.Header.Set("Content-Length", decoded)
+		}
+		ifMatch, ifNoneMatch := r.Header.Get("If-Match"), r.Header.Get("If-None-Match")
+		if ifMatch == "" && ifNoneMatch == "" {
+			h.ServeHTTP(w, r)
+			return
+		}
+		// check and write atomically
+		mu.Lock()
+		defer mu.Unlock()
+		head := httptest.NewRecorder()
+		h.ServeHTTP(head, httptest.NewRequest(http.MethodHead, r.URL.String(), nil))
+		etag := ""
+		if head.Code == http.StatusOK {
+			etag = head.Header().Get("ETag")
+		}
+		if (ifNoneMatch == "*" && etag != "") || (ifMatch != "" && ifMatch != etag) {
+			w.WriteHeader(http.StatusPreconditionFailed)
+			fmt.Fprint(w, `<?xml version="1.0" encoding="UTF-8"?><Error><Code>PreconditionFailed</Code><Message>At least one of the pre-conditions you specified did not hold</Message></Error>`)
+			return
+		}
+		h.ServeHTTP(w, r)
+	}))
+}
@@ -0,0 +1,23 @@
+package s3
+
+// ObjectStore is the interface of the S3 operations used to manage volumes
+type ObjectStore interface {
+	MetaStore
+	BucketExists(bucketName string) (bool, error)
+	CreateBucket(bucketName string) error
+	CreatePrefix(bucketName string, prefix string) error
+	RemovePrefix(bucketName string, prefix string) error
+	RemoveBucket(bucketName string) error
+	// ListObjects returns the keys of the objects directly within prefix
+	// and of the prefixes below it, which end with a slash
+	ListObjects(bucketName string, prefix string) ([]string, error)
+	// PrefixUsage returns the total size of the objects within prefix,
+	// an empty prefix returns the size of the bucket
+	PrefixUsage(bucketName string, prefix string) (int64, error)
+	// SetBucketQuota limits the size of the bucket to quotaBytes
+	SetBucketQuota(bucketName string, quotaBytes int64) error
+	// MetaStore returns the metadata store of type storeType
+	MetaStore(storeType string, volumeContext map[string]string) (MetaStore, error)
+}
+
+var _ ObjectStore = &s3Client{}
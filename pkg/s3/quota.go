@@ -0,0 +1,112 @@
+package s3
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/ctrox/csi-s3/pkg/metrics"
+	"github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/signer"
+)
+
+const (
+	// QuotaEnforcementKey selects in the storage class parameters what
+	// happens when the usage of a volume exceeds its capacity, by default
+	// it is only reported
+	QuotaEnforcementKey = "quotaEnforcement"
+	// QuotaReadOnly publishes volumes read only while they exceed their capacity
+	QuotaReadOnly = "read-only"
+	// QuotaBucket sets a hard quota of the capacity on the bucket of
+	// the volume, which is only supported by MinIO
+	QuotaBucket = "bucket-quota"
+)
+
+// IsSupportedQuotaEnforcement returns true if enforcement is known,
+// an empty enforcement only reports volumes exceeding their capacity
+func IsSupportedQuotaEnforcement(enforcement string) bool {
+	switch enforcement {
+	case "", QuotaReadOnly, QuotaBucket:
+		return true
+	}
+	return false
+}
+
+// ValidateQuotaEnforcement returns an error if the quota enforcement
+// of meta is unknown or cannot be applied to the volume
+func ValidateQuotaEnforcement(meta *FSMeta) error {
+	if !IsSupportedQuotaEnforcement(meta.QuotaEnforcement) {
+		return fmt.Errorf("unknown quota enforcement %q", meta.QuotaEnforcement)
+	}
+	if meta.QuotaEnforcement == QuotaBucket && (meta.UsePrefix || meta.Prefix != "") {
+		return fmt.Errorf("quota enforcement %s requires a volume with its own bucket", meta.QuotaEnforcement)
+	}
+	return nil
+}
+
+// bucketQuota is the request of the MinIO admin API to set a bucket quota
+type bucketQuota struct {
+	Quota int64  `json:"quota"`
+	Type  string `json:"quotatype"`
+}
+
+func (client *s3Client) PrefixUsage(bucketName string, prefix string) (usage int64, err error) {
+	defer metrics.ObserveS3Operation("PrefixUsage", time.Now(), &err)
+
+	dir := ""
+	if prefix != "" {
+		dir = prefix + "/"
+	}
+	for object := range client.minio.ListObjects(client.ctx, bucketName, minio.ListObjectsOptions{Prefix: dir, Recursive: true}) {
+		if object.Err != nil {
+			return 0, object.Err
+		}
+		usage += object.Size
+	}
+	return usage, nil
+}
+
+// SetBucketQuota sets a hard quota on the bucket with the admin API
+// of MinIO, minio-go does not support it. A zero quota removes it.
+func (client *s3Client) SetBucketQuota(bucketName string, quotaBytes int64) (err error) {
+	defer metrics.ObserveS3Operation("SetBucketQuota", time.Now(), &err)
+
+	body, err := json.Marshal(&bucketQuota{Quota: quotaBytes, Type: "hard"})
+	if err != nil {
+		return err
+	}
+	u, err := url.Parse(client.Config.Endpoint)
+	if err != nil {
+		return err
+	}
+	u.Path = "/minio/admin/v3/set-bucket-quota"
+	u.RawQuery = url.Values{"bucket": []string{bucketName}}.Encode()
+	req, err := http.NewRequestWithContext(client.ctx, http.MethodPut, u.String(), bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	sum := sha256.Sum256(body)
+	req.Header.Set("X-Amz-Content-Sha256", hex.EncodeToString(sum[:]))
+	region := client.Config.Region
+	if region == "" {
+		region = "us-east-1"
+	}
+	req = signer.SignV4(*req, client.Config.AccessKeyID, client.Config.SecretAccessKey, "", region)
+
+	resp, err := client.http.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := ioutil.ReadAll(resp.Body)
+		return fmt.Errorf("setting quota of bucket %s failed with %s: %s", bucketName, resp.Status, bytes.TrimSpace(msg))
+	}
+	return nil
+}
@@ -0,0 +1,70 @@
+package s3
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestValidateQuotaEnforcement(t *testing.T) {
+	for _, meta := range []*FSMeta{
+		{},
+		{QuotaEnforcement: QuotaReadOnly, Prefix: "pvc-1"},
+		{QuotaEnforcement: QuotaBucket},
+	} {
+		if err := ValidateQuotaEnforcement(meta); err != nil {
+			t.Errorf("unexpected error for %+v: %s", meta, err)
+		}
+	}
+	for _, meta := range []*FSMeta{
+		{QuotaEnforcement: "hard"},
+		{QuotaEnforcement: QuotaBucket, Prefix: "pvc-1"},
+		{QuotaEnforcement: QuotaBucket, UsePrefix: true},
+	} {
+		if err := ValidateQuotaEnforcement(meta); err == nil {
+			t.Errorf("expected error for %+v", meta)
+		}
+	}
+}
+
+func TestSetBucketQuota(t *testing.T) {
+	var req *http.Request
+	quota := &bucketQuota{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		req = r
+		json.NewDecoder(r.Body).Decode(quota)
+	}))
+	defer server.Close()
+	client, err := NewClient(&Config{Endpoint: server.URL, AccessKeyID: "key", SecretAccessKey: "secret"})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	if err := client.SetBucketQuota("bucket", 1024); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if req.Method != http.MethodPut || req.URL.Path != "/minio/admin/v3/set-bucket-quota" || req.URL.Query().Get("bucket") != "bucket" {
+		t.Errorf("unexpected request %s %s", req.Method, req.URL)
+	}
+	if !strings.HasPrefix(req.Header.Get("Authorization"), "AWS4-HMAC-SHA256 Credential=key/") {
+		t.Errorf("expected a signed request, got Authorization %q", req.Header.Get("Authorization"))
+	}
+	if quota.Quota != 1024 || quota.Type != "hard" {
+		t.Errorf("unexpected quota %+v", quota)
+	}
+}
+
+func TestPrefixUsage(t *testing.T) {
+	store := NewFakeObjectStore()
+	store.CreateBucket("bucket")
+	store.PutObject("bucket", "pvc-1/csi-fs/file", []byte("data"))
+	store.PutObject("bucket", "pvc-10/csi-fs/file", []byte("other data"))
+	if usage, err := store.PrefixUsage("bucket", "pvc-1"); err != nil || usage != 4 {
+		t.Errorf("expected usage 4 of the prefix, got %d, %v", usage, err)
+	}
+	if usage, err := store.PrefixUsage("bucket", ""); err != nil || usage != 14 {
+		t.Errorf("expected usage 14 of the bucket, got %d, %v", usage, err)
+	}
+}
@@ -0,0 +1,92 @@
+package s3
+
+import (
+	"fmt"
+	"strings"
+)
+
+const (
+	// ReclaimPolicyKey selects what is removed when a volume
+	// is deleted in the storage class parameters
+	ReclaimPolicyKey = "reclaimPolicy"
+	// ReclaimDeleteBucket removes the bucket of a volume without prefix.
+	// Only buckets created by the driver which contain nothing but the
+	// data and metadata of the volume are removed.
+	ReclaimDeleteBucket = "delete-bucket"
+	// ReclaimDeletePrefix removes the prefix of a volume and keeps the bucket
+	ReclaimDeletePrefix = "delete-prefix"
+	// ReclaimRetain keeps the data of a volume
+	ReclaimRetain = "retain"
+)
+
+// IsSupportedReclaimPolicy returns true if policy is known,
+// an empty policy selects the default of the volume
+func IsSupportedReclaimPolicy(policy string) bool {
+	switch policy {
+	case "", ReclaimDeleteBucket, ReclaimDeletePrefix, ReclaimRetain:
+		return true
+	}
+	return false
+}
+
+// DefaultReclaimPolicy returns the policy of volumes which do not select one.
+// Volumes sharing an existing prefix are retained, the others
+// remove their prefix or, if they have none, their bucket.
+func DefaultReclaimPolicy(usePrefix bool, prefix string) string {
+	switch {
+	case usePrefix:
+		return ReclaimRetain
+	case prefix != "":
+		return ReclaimDeletePrefix
+	}
+	return ReclaimDeleteBucket
+}
+
+// ValidateReclaimPolicy returns an error if the reclaim policy of meta
+// could remove data which does not belong to the volume
+func ValidateReclaimPolicy(meta *FSMeta) error {
+	switch meta.ReclaimPolicy {
+	case ReclaimRetain:
+		return nil
+	case ReclaimDeleteBucket:
+		if meta.UsePrefix || meta.Prefix != "" {
+			return fmt.Errorf("reclaim policy %s requires a volume with its own bucket", meta.ReclaimPolicy)
+		}
+	case ReclaimDeletePrefix:
+		if meta.UsePrefix || meta.Prefix == "" {
+			return fmt.Errorf("reclaim policy %s requires a volume with its own prefix", meta.ReclaimPolicy)
+		}
+	default:
+		return fmt.Errorf("unknown reclaim policy %q", meta.ReclaimPolicy)
+	}
+	return nil
+}
+
+// ForeignObjects returns the objects and prefixes in the bucket of a volume
+// without prefix which are neither its data in FSPath nor its metadata.
+// Only the path to FSPath is listed, not the data of the volume.
+func ForeignObjects(store ObjectStore, meta *FSMeta) ([]string, error) {
+	if meta.FSPath == "" {
+		// the data of the volume is the whole bucket
+		return nil, nil
+	}
+	foreign := []string{}
+	dir := ""
+	for _, element := range strings.Split(strings.Trim(meta.FSPath, "/"), "/") {
+		keys, err := store.ListObjects(meta.BucketName, dir)
+		if err != nil {
+			return nil, err
+		}
+		owned := dir + element + "/"
+		for _, key := range keys {
+			// some S3 implementations store the marker
+			// of a prefix without its trailing slash
+			if key == owned || key == dir+element || key == dir || (dir == "" && key == metadataName) {
+				continue
+			}
+			foreign = append(foreign, key)
+		}
+		dir = owned
+	}
+	return foreign, nil
+}
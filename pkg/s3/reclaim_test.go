@@ -0,0 +1,63 @@
+package s3
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestValidateReclaimPolicy(t *testing.T) {
+	for _, meta := range []*FSMeta{
+		{ReclaimPolicy: ReclaimDeleteBucket},
+		{ReclaimPolicy: ReclaimDeletePrefix, Prefix: "pvc-1"},
+		{ReclaimPolicy: ReclaimRetain, Prefix: "data", UsePrefix: true},
+		{ReclaimPolicy: ReclaimRetain},
+	} {
+		if err := ValidateReclaimPolicy(meta); err != nil {
+			t.Errorf("unexpected error for %+v: %s", meta, err)
+		}
+	}
+	for _, meta := range []*FSMeta{
+		{},
+		{ReclaimPolicy: "delete"},
+		{ReclaimPolicy: ReclaimDeleteBucket, Prefix: "pvc-1"},
+		{ReclaimPolicy: ReclaimDeleteBucket, UsePrefix: true},
+		{ReclaimPolicy: ReclaimDeletePrefix},
+		{ReclaimPolicy: ReclaimDeletePrefix, Prefix: "data", UsePrefix: true},
+	} {
+		if err := ValidateReclaimPolicy(meta); err == nil {
+			t.Errorf("expected error for %+v", meta)
+		}
+	}
+}
+
+func TestForeignObjects(t *testing.T) {
+	store := NewFakeObjectStore()
+	store.CreateBucket("bucket")
+	store.CreatePrefix("bucket", "csi/fs")
+	store.PutObject("bucket", ".metadata.json", []byte("{}"))
+	store.PutObject("bucket", "csi/fs/file", []byte("data"))
+	meta := &FSMeta{BucketName: "bucket", FSPath: "csi/fs"}
+
+	foreign, err := ForeignObjects(store, meta)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if len(foreign) != 0 {
+		t.Errorf("expected no foreign objects, got %v", foreign)
+	}
+
+	store.PutObject("bucket", "other/file", []byte("data"))
+	store.PutObject("bucket", "csi/file", []byte("data"))
+	foreign, err = ForeignObjects(store, meta)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if !reflect.DeepEqual(foreign, []string{"other/", "csi/file"}) {
+		t.Errorf("unexpected foreign objects %v", foreign)
+	}
+
+	// a volume without FSPath owns the whole bucket
+	if foreign, err := ForeignObjects(store, &FSMeta{BucketName: "bucket"}); err != nil || len(foreign) != 0 {
+		t.Errorf("expected no foreign objects, got %v, %v", foreign, err)
+	}
+}
@@ -0,0 +1,147 @@
+package e2e
+
+import (
+	"bytes"
+	"context"
+	"math/rand"
+	"path/filepath"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/kubernetes-csi/csi-test/utils"
+	"google.golang.org/grpc"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Data integrity", func() {
+	for _, mounterType := range []string{"goofys", "s3fs", "rclone", "s3backer"} {
+		mounterType := mounterType
+		Context(mounterType, func() {
+			skipUnlessMountable(mounterType)
+
+			var (
+				address    = startDriver("data-" + mounterType)
+				staging    = filepath.Join(workDir, "data-"+mounterType+"-staging")
+				target     = filepath.Join(workDir, "data-"+mounterType+"-target")
+				conn       *grpc.ClientConn
+				controller csi.ControllerClient
+				node       csi.NodeClient
+				volumeID   string
+			)
+			capability := &csi.VolumeCapability{
+				AccessType: &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{}},
+				AccessMode: &csi.VolumeCapability_AccessMode{Mode: csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER},
+			}
+
+			stage := func() {
+				_, err := node.NodeStageVolume(context.Background(), &csi.NodeStageVolumeRequest{
+					VolumeId:          volumeID,
+					StagingTargetPath: staging,
+					VolumeCapability:  capability,
+					Secrets:           secrets(),
+				})
+				Expect(err).NotTo(HaveOccurred())
+			}
+			publish := func(readOnly bool) {
+				_, err := node.NodePublishVolume(context.Background(), &csi.NodePublishVolumeRequest{
+					VolumeId:          volumeID,
+					StagingTargetPath: staging,
+					TargetPath:        target,
+					VolumeCapability:  capability,
+					Readonly:          readOnly,
+					Secrets:           secrets(),
+				})
+				Expect(err).NotTo(HaveOccurred())
+			}
+			unmount := func() {
+				_, err := node.NodeUnpublishVolume(context.Background(), &csi.NodeUnpublishVolumeRequest{
+					VolumeId:   volumeID,
+					TargetPath: target,
+				})
+				Expect(err).NotTo(HaveOccurred())
+				_, err = node.NodeUnstageVolume(context.Background(), &csi.NodeUnstageVolumeRequest{
+					VolumeId:          volumeID,
+					StagingTargetPath: staging,
+				})
+				Expect(err).NotTo(HaveOccurred())
+			}
+
+			BeforeEach(func() {
+				var err error
+				conn, err = utils.Connect(address)
+				Expect(err).NotTo(HaveOccurred())
+				controller = csi.NewControllerClient(conn)
+				node = csi.NewNodeClient(conn)
+
+				resp, err := controller.CreateVolume(context.Background(), &csi.CreateVolumeRequest{
+					Name:               "data-" + mounterType,
+					CapacityRange:      &csi.CapacityRange{RequiredBytes: 1 << 30},
+					VolumeCapabilities: []*csi.VolumeCapability{capability},
+					Parameters:         map[string]string{"mounter": mounterType, "bucket": "databucket"},
+					Secrets:            secrets(),
+				})
+				Expect(err).NotTo(HaveOccurred())
+				volumeID = resp.GetVolume().GetVolumeId()
+				stage()
+				publish(false)
+			})
+
+			AfterEach(func() {
+				defer conn.Close()
+				if volumeID == "" {
+					return
+				}
+				unmount()
+				_, err := controller.DeleteVolume(context.Background(), &csi.DeleteVolumeRequest{
+					VolumeId: volumeID,
+					Secrets:  secrets(),
+				})
+				Expect(err).NotTo(HaveOccurred())
+				volumeID = ""
+			})
+
+			It("keeps data after remounting", func() {
+				large := make([]byte, 5<<20)
+				rand.New(rand.NewSource(1)).Read(large)
+				files := map[string][]byte{
+					"small.txt":          []byte("hello csi-s3"),
+					"large.bin":          large,
+					"nested/dir/file.md": []byte("# nested"),
+				}
+				for name, content := range files {
+					Expect(writeFile(filepath.Join(target, name), content)).To(Succeed())
+				}
+				Expect(removeFile(filepath.Join(target, "small.txt"))).To(Succeed())
+				delete(files, "small.txt")
+
+				unmount()
+				stage()
+				publish(false)
+
+				for name, content := range files {
+					read, err := readFile(filepath.Join(target, name))
+					Expect(err).NotTo(HaveOccurred())
+					Expect(bytes.Equal(read, content)).To(BeTrue(), "content of %s differs", name)
+				}
+				_, err := readFile(filepath.Join(target, "small.txt"))
+				Expect(err).To(HaveOccurred(), "removed file exists again")
+			})
+
+			It("does not allow writes to read only targets", func() {
+				Expect(writeFile(filepath.Join(target, "file"), []byte("data"))).To(Succeed())
+				_, err := node.NodeUnpublishVolume(context.Background(), &csi.NodeUnpublishVolumeRequest{
+					VolumeId:   volumeID,
+					TargetPath: target,
+				})
+				Expect(err).NotTo(HaveOccurred())
+				publish(true)
+
+				read, err := readFile(filepath.Join(target, "file"))
+				Expect(err).NotTo(HaveOccurred())
+				Expect(string(read)).To(Equal("data"))
+				Expect(writeFile(filepath.Join(target, "other"), []byte("data"))).NotTo(Succeed())
+			})
+		})
+	}
+})
@@ -0,0 +1,228 @@
+package e2e
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/ctrox/csi-s3/pkg/driver"
+	"github.com/ctrox/csi-s3/pkg/mounter"
+	"github.com/johannesboyne/gofakes3"
+	"github.com/johannesboyne/gofakes3/backend/s3mem"
+	"k8s.io/mount-utils"
+
+	. "github.com/onsi/ginkgo"
+	"github.com/onsi/ginkgo/config"
+	. "github.com/onsi/gomega"
+)
+
+// the embedded S3 server and all files of the tests live as long as the test binary
+var (
+	workDir     = mustTempDir()
+	s3Server    = httptest.NewServer(withCompat(gofakes3.New(s3mem.New()).Server()))
+	secretsFile = writeSecrets(filepath.Join(workDir, "secret.yaml"), s3Server.URL)
+	mountError  = checkMountPrivileges()
+)
+
+func TestE2E(t *testing.T) {
+	// csi-test v2 predates the VOLUME_MOUNT_GROUP capability of the node
+	// service and rejects it as unknown. "Node capabilities" checks them
+	// against the CSI spec instead, remove both once csi-test is bumped.
+	config.GinkgoConfig.SkipStrings = append(config.GinkgoConfig.SkipStrings, "NodeGetCapabilities should return appropriate capabilities")
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "E2E")
+}
+
+var _ = AfterSuite(func() {
+	s3Server.Close()
+	os.RemoveAll(workDir)
+})
+
+// withCompat works around differences between gofakes3 and S3 in the
+// requests minio-go sends: streaming uploads without a Content-Length
+// header are rejected and an empty delimiter does not list recursively.
+// gofakes3 also strips the trailing slash of keys, so directory markers
+// like dir/ and files like dir are the same object, see markers.
+func withCompat(h http.Handler) http.Handler {
+	markers := &directoryMarkers{keys: map[string]bool{}}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodPut && r.Header.Get("Content-Length") == "" {
+			if decoded := r.Header.Get("X-Amz-Decoded-Content-Length"); decoded != "" {
+				r.Header.Set("Content-Length", decoded)
+			}
+		}
+		if q := r.URL.Query(); r.Method == http.MethodGet && q.Get("delimiter") == "" {
+			if _, ok := q["delimiter"]; ok {
+				q.Del("delimiter")
+				r.URL.RawQuery = q.Encode()
+			}
+		}
+		if !markers.track(r) {
+			w.Header().Set("Content-Type", "application/xml")
+			w.WriteHeader(http.StatusNotFound)
+			fmt.Fprint(w, `<Error><Code>NoSuchKey</Code><Message>The specified key does not exist.</Message></Error>`)
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+// directoryMarkers remembers which objects have been written with a
+// trailing slash. Without it, goofys randomly takes files for directories
+// and the other way round, depending on which of its concurrent lookups
+// of name and name/ returns first.
+type directoryMarkers struct {
+	mu   sync.Mutex
+	keys map[string]bool
+}
+
+// track records writes and deletes of object keys and returns false
+// if r reads a file as a directory marker or a marker as a file
+func (m *directoryMarkers) track(r *http.Request) bool {
+	if strings.Count(strings.Trim(r.URL.Path, "/"), "/") == 0 || r.URL.RawQuery != "" {
+		// buckets, listings and multipart uploads
+		return true
+	}
+	key := strings.TrimSuffix(r.URL.Path, "/")
+	isMarker := strings.HasSuffix(r.URL.Path, "/")
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	switch r.Method {
+	case http.MethodPut:
+		m.keys[key] = isMarker
+	case http.MethodDelete:
+		delete(m.keys, key)
+	case http.MethodGet, http.MethodHead:
+		if marker, ok := m.keys[key]; ok && marker != isMarker {
+			return false
+		}
+	}
+	return true
+}
+
+func mustTempDir() string {
+	dir, err := ioutil.TempDir("", "csi-s3-e2e")
+	if err != nil {
+		log.Fatal(err)
+	}
+	return dir
+}
+
+// writeSecrets writes a csi-sanity secrets file for the S3 endpoint
+func writeSecrets(path string, endpoint string) string {
+	secret := fmt.Sprintf(`
+  accessKeyID: FJDSJ
+  secretAccessKey: DSG643HGDS
+  endpoint: %s
+  region: ""
+`, endpoint)
+	content := ""
+	for _, name := range []string{
+		"CreateVolumeSecret",
+		"DeleteVolumeSecret",
+		"NodeStageVolumeSecret",
+		"NodePublishVolumeSecret",
+		"ControllerValidateVolumeCapabilitiesSecret",
+	} {
+		content += name + ":" + secret
+	}
+	if err := ioutil.WriteFile(path, []byte(content), 0600); err != nil {
+		log.Fatal(err)
+	}
+	return path
+}
+
+func secrets() map[string]string {
+	return map[string]string{
+		"accessKeyID":     "FJDSJ",
+		"secretAccessKey": "DSG643HGDS",
+		"endpoint":        s3Server.URL,
+	}
+}
+
+// checkMountPrivileges returns an error if this process cannot mount FUSE filesystems
+func checkMountPrivileges() error {
+	fuse, err := os.OpenFile("/dev/fuse", os.O_RDWR, 0)
+	if err != nil {
+		return fmt.Errorf("fuse is not available: %s", err)
+	}
+	fuse.Close()
+	source, target := filepath.Join(workDir, "mount-source"), filepath.Join(workDir, "mount-target")
+	for _, dir := range []string{source, target} {
+		if err := os.MkdirAll(dir, 0750); err != nil {
+			return err
+		}
+	}
+	m := mount.New("")
+	if err := m.Mount(source, target, "", []string{"bind"}); err != nil {
+		return fmt.Errorf("mounting is not permitted: %s", err)
+	}
+	return m.Unmount(target)
+}
+
+// skipUnlessMountable skips the specs of the container if mounterType cannot be used
+func skipUnlessMountable(mounterType string) {
+	BeforeEach(func() {
+		if mountError != nil {
+			Skip(mountError.Error())
+		}
+		if _, err := mounter.Check(mounterType); err != nil {
+			Skip(fmt.Sprintf("mounter %s is not available: %s", mounterType, err))
+		}
+	})
+}
+
+// goofys serves its mounts from within the driver and thus this process,
+// accessing them from here can deadlock the FUSE server, so the files of
+// mounted volumes are accessed from a child process
+
+// writeFile writes content to path in a child process, creating missing directories
+func writeFile(path string, content []byte) error {
+	cmd := exec.Command("sh", "-c", `mkdir -p "$(dirname "$1")" && cat > "$1"`, "sh", path)
+	cmd.Stdin = bytes.NewReader(content)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("writing %s failed: %s: %s", path, err, out)
+	}
+	return nil
+}
+
+// readFile returns the content of path read in a child process
+func readFile(path string) ([]byte, error) {
+	out, err := exec.Command("cat", path).Output()
+	if err != nil {
+		return nil, fmt.Errorf("reading %s failed: %s", path, err)
+	}
+	return out, nil
+}
+
+// removeFile removes path in a child process
+func removeFile(path string) error {
+	if out, err := exec.Command("rm", path).CombinedOutput(); err != nil {
+		return fmt.Errorf("removing %s failed: %s: %s", path, err, out)
+	}
+	return nil
+}
+
+// startDriver runs a driver with all services on a socket named after name
+// and returns its endpoint
+func startDriver(name string) string {
+	socket := filepath.Join(workDir, name+".sock")
+	endpoint := "unix://" + socket
+	d, err := driver.New(&driver.Config{
+		NodeID:   "test-node",
+		Endpoint: endpoint,
+		StateDir: filepath.Join(workDir, name+"-state"),
+	})
+	Expect(err).NotTo(HaveOccurred())
+	go d.Run()
+	return endpoint
+}
@@ -0,0 +1,60 @@
+package e2e
+
+import (
+	"context"
+	"path/filepath"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/kubernetes-csi/csi-test/pkg/sanity"
+	"github.com/kubernetes-csi/csi-test/utils"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("CSI sanity", func() {
+	for _, tc := range []struct {
+		name       string
+		parameters map[string]string
+	}{
+		{name: "goofys", parameters: map[string]string{"mounter": "goofys", "bucket": "testbucket0"}},
+		{name: "goofys-no-bucket", parameters: map[string]string{"mounter": "goofys"}},
+		{name: "s3fs", parameters: map[string]string{"mounter": "s3fs", "bucket": "testbucket1"}},
+		{name: "s3backer", parameters: map[string]string{"mounter": "s3backer", "bucket": "testbucket2"}},
+		{name: "rclone", parameters: map[string]string{"mounter": "rclone", "bucket": "testbucket3"}},
+	} {
+		tc := tc
+		Context(tc.name, func() {
+			skipUnlessMountable(tc.parameters["mounter"])
+			sanity.GinkgoTest(&sanity.Config{
+				TargetPath:           filepath.Join(workDir, tc.name+"-target"),
+				StagingPath:          filepath.Join(workDir, tc.name+"-staging"),
+				Address:              startDriver("sanity-" + tc.name),
+				SecretsFile:          secretsFile,
+				TestVolumeParameters: tc.parameters,
+			})
+		})
+	}
+})
+
+var _ = Describe("Node capabilities", func() {
+	address := startDriver("capabilities")
+
+	It("are known to the CSI spec", func() {
+		conn, err := utils.Connect(address)
+		Expect(err).NotTo(HaveOccurred())
+		defer conn.Close()
+
+		caps, err := csi.NewNodeClient(conn).NodeGetCapabilities(context.Background(), &csi.NodeGetCapabilitiesRequest{})
+		Expect(err).NotTo(HaveOccurred())
+		types := []csi.NodeServiceCapability_RPC_Type{}
+		for _, cap := range caps.GetCapabilities() {
+			Expect(cap.GetRpc()).NotTo(BeNil())
+			_, known := csi.NodeServiceCapability_RPC_Type_name[int32(cap.GetRpc().GetType())]
+			Expect(known).To(BeTrue(), "unknown capability %v", cap.GetRpc().GetType())
+			types = append(types, cap.GetRpc().GetType())
+		}
+		Expect(types).To(ContainElement(csi.NodeServiceCapability_RPC_STAGE_UNSTAGE_VOLUME))
+		Expect(types).To(ContainElement(csi.NodeServiceCapability_RPC_VOLUME_MOUNT_GROUP))
+	})
+})
@@ -1,8 +1,3 @@
 #!/usr/bin/env bash
-export MINIO_ACCESS_KEY=FJDSJ
-export MINIO_SECRET_KEY=DSG643HGDS
-
-mkdir -p /tmp/minio
-minio server /tmp/minio &>/dev/null &
-sleep 5
+# the e2e tests in test/e2e run their own S3 server
 go test ./... -cover -ginkgo.noisySkippings=false